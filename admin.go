@@ -0,0 +1,155 @@
+package zddgo
+
+import(
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"regexp"
+	"strings"
+	"time"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/feekk/zddgo/metrics"
+	"github.com/feekk/zddgo/redis"
+)
+
+var(
+	redactKeys = []string{"pwd", "passwd", "password", "secret", "token"}
+	dsnPassword = regexp.MustCompile(`(^|//)([^:@/]*):[^@/]*@`)
+)
+
+const redacted = "******"
+
+// readyzTimeout bounds a readiness probe, a waiting pool must not hang it
+const readyzTimeout = 3 * time.Second
+
+//
+// AdminRegister mounts the admin endpoints on router, e.t. engine.Group("/admin").
+//
+func AdminRegister(router gin.IRoutes){
+	router.GET("/healthz", adminHealthz)
+	router.GET("/readyz", adminReadyz)
+	router.GET("/debug/pools", adminPools)
+	router.GET("/debug/config", adminConfig)
+	router.GET("/metrics", gin.WrapH(metrics.Handler()))
+	router.GET("/debug/pprof/*name", adminPprof)
+	router.POST("/debug/pprof/*name", adminPprof)
+}
+
+//
+// AdminHandler returns a standalone handler serving the admin endpoints, it is
+// served on Conf.Http.Admin by default.
+//
+func AdminHandler() http.Handler{
+	engine := gin.New()
+	AdminRegister(engine)
+	return engine
+}
+
+func adminHealthz(ctx *gin.Context){
+	ctx.String(http.StatusOK, "ok")
+}
+
+func adminReadyz(ctx *gin.Context){
+	status := http.StatusOK
+	result := make(map[string]string)
+	check := func(name string, err error){
+		if err != nil {
+			status = http.StatusServiceUnavailable
+			result[name] = err.Error()
+		} else {
+			result[name] = "ok"
+		}
+	}
+	reqCtx, cancel := context.WithTimeout(ctx.Request.Context(), readyzTimeout)
+	defer cancel()
+	rangeMysql(func(name string, db *gorm.DB){
+		check("mysql." + name, db.DB().PingContext(reqCtx))
+	})
+	rangeRedis(func(name string, pool *redis.RedisPool){
+		conn := pool.GetContext(reqCtx)
+		_, err := conn.Do("PING")
+		conn.Close()
+		check("redis." + name, err)
+	})
+	ctx.JSON(status, result)
+}
+
+func adminPools(ctx *gin.Context){
+	redisStats := make(map[string][]redis.PoolStats)
+	rangeRedis(func(name string, pool *redis.RedisPool){
+		redisStats[name] = pool.GetPoolStats()
+	})
+	mysqlStats := make(map[string]sql.DBStats)
+	rangeMysql(func(name string, db *gorm.DB){
+		mysqlStats[name] = db.DB().Stats()
+	})
+	ctx.JSON(http.StatusOK, gin.H{
+		"redis": redisStats,
+		"mysql": mysqlStats,
+	})
+}
+
+func adminConfig(ctx *gin.Context){
+	if Conf == nil {
+		ctx.JSON(http.StatusOK, nil)
+		return
+	}
+	var conf interface{}
+	b, err := json.Marshal(Conf)
+	if err == nil {
+		err = json.Unmarshal(b, &conf)
+	}
+	if err != nil {
+		ctx.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, redact("", conf))
+}
+
+func adminPprof(ctx *gin.Context){
+	switch name := strings.TrimPrefix(ctx.Param("name"), "/"); name {
+	case "":
+		pprof.Index(ctx.Writer, ctx.Request)
+	case "cmdline":
+		pprof.Cmdline(ctx.Writer, ctx.Request)
+	case "profile":
+		pprof.Profile(ctx.Writer, ctx.Request)
+	case "symbol":
+		pprof.Symbol(ctx.Writer, ctx.Request)
+	case "trace":
+		pprof.Trace(ctx.Writer, ctx.Request)
+	default:
+		pprof.Handler(name).ServeHTTP(ctx.Writer, ctx.Request)
+	}
+}
+
+//
+// redact masks fields named like a secret and the password part of dsn in a decoded json value.
+//
+func redact(key string, v interface{}) interface{}{
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, sub := range val {
+			val[k] = redact(k, sub)
+		}
+	case []interface{}:
+		for i, sub := range val {
+			val[i] = redact(key, sub)
+		}
+	case string:
+		lower := strings.ToLower(key)
+		for _, k := range redactKeys {
+			//e.t. Pwd, SentinelPwd, ApiToken
+			if strings.Contains(lower, k) && val != "" {
+				return redacted
+			}
+		}
+		if lower == "dsn" {
+			return dsnPassword.ReplaceAllString(val, "${1}${2}:" + redacted + "@")
+		}
+	}
+	return v
+}
@@ -0,0 +1,35 @@
+package zddgo
+
+import(
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminConfigRedact(t *testing.T){
+	old := Conf
+	defer func(){ Conf = old }()
+	Conf = &Config{}
+	Conf.Redis.Default = RedisPoolConfig{Dsn: "127.0.0.1:6379", Pwd: "redispwd", MasterName: "mymaster", SentinelPwd: "sentinelsecret"}
+	Conf.Database.Default = OrmPoolConfig{DSN: "root:mysqlpwd@tcp(127.0.0.1:3306)/zddgo"}
+
+	handler := AdminHandler()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/config", nil))
+	body := w.Body.String()
+	if w.Code != http.StatusOK || strings.Contains(body, "redispwd") || strings.Contains(body, "sentinelsecret") || strings.Contains(body, "mysqlpwd") {
+		t.Errorf("config not redacted: %s", body)
+	}
+	if !strings.Contains(body, "root:******@tcp(127.0.0.1:3306)/zddgo") || !strings.Contains(body, "127.0.0.1:6379") {
+		t.Errorf("config over redacted: %s", body)
+	}
+
+	for _, path := range []string{"/healthz", "/readyz", "/debug/pools", "/debug/pprof/", "/debug/pprof/goroutine"} {
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s status %d", path, w.Code)
+		}
+	}
+}
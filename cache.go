@@ -1,8 +1,11 @@
 package zddgo
 
 import(
+	"context"
+	"crypto/tls"
 	"time"
 	"strings"
+	"github.com/feekk/zddgo/log"
 	"github.com/feekk/zddgo/redis"
 	"github.com/feekk/zddgo/ztime"
 	"github.com/feekk/zddgo/errors"
@@ -12,9 +15,67 @@ import(
 func NewRedisPool(c *RedisPoolConfig) (p *redis.RedisPool, err error){
 	servers := strings.Split(c.Dsn, ";")
 	factory := redis.RedisPooledConnFactory{
+		Username: c.User,
+		Password: c.Pwd,
+		Db: c.Db,
+		UseTLS: c.Tls,
 		ConnectTimeout: time.Duration(c.ConnectTimeout),
 		ReadTimeout: time.Duration(c.ReadTimeout),
 		WriteTimeout: time.Duration(c.WriteTimeout),
+		Name: c.Name,
+	}
+	if factory.Name == "" {
+		//same as rangeRedis
+		factory.Name = "default"
+	}
+	if c.Instrument {
+		factory.Observer = observeRedisCommand
+		factory.SlowThreshold = time.Duration(c.SlowLog)
+	}
+	if c.Tls && c.TlsSkipVerify {
+		factory.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	if c.SetName && Conf != nil {
+		factory.ClientName = Conf.App.Name
+	}
+	//pool config
+	maxFails := c.MaxFails
+	if maxFails <= 0 {
+		maxFails = 5
+	}
+	conf := redis.PoolConfig{
+		MaxIdle: c.MaxIdle,
+		MaxActive: c.MaxActive,
+		IdleTimeout: time.Duration(c.IdleTimeout),
+		MaxFails: maxFails,
+		TestOnBorrow: c.TestOnBorrow,
+		TestIdleThreshold: time.Duration(c.TestIdleThreshold),
+		Wait: c.Wait,
+		WaitTimeout: time.Duration(c.WaitTimeout),
+		Weights: c.Weights,
+		CheckInterval: time.Duration(c.CheckInterval),
+		CheckTries: c.CheckTries,
+		MaxUnavailable: c.MaxUnavailable,
+		OnAvailabilityChange: logRedisShardChange(factory.Name),
+	}
+	//sentinel mode, Dsn is the sentinel list
+	if c.MasterName != "" {
+		p, err = redis.NewSentinelPool(redis.SentinelConfig{
+			MasterName: c.MasterName,
+			Addrs: servers,
+			Password: c.SentinelPwd,
+			ConnectTimeout: time.Duration(c.ConnectTimeout),
+			ReadTimeout: time.Duration(c.ReadTimeout),
+			ReadFromReplicas: c.ReadFromReplicas,
+		}, factory, conf)
+		err = errors.With(err)
+		return
+	}
+	//cluster mode, Dsn is the seed nodes
+	if c.Cluster {
+		p, err = redis.NewClusterPool(redis.ClusterConfig{Addrs: servers}, factory, conf)
+		err = errors.With(err)
+		return
 	}
 	//check
 	var pc redis.Poolable
@@ -31,30 +92,79 @@ func NewRedisPool(c *RedisPoolConfig) (p *redis.RedisPool, err error){
 		factory.Close(pc)
 	}
 	//instance
-	conf := redis.PoolConfig{
-		MaxIdle: c.MaxIdle,
-		MaxActive: c.MaxActive,
-		IdleTimeout: time.Duration(c.IdleTimeout),
-		MaxFails:5,
-	}
-	if c.Pwd != "" {
-		factory.Password = c.Pwd
-	}
-
 	p = redis.NewRedisPool(servers, factory, conf)
 	return 
 }
 
+//
+// logRedisShardChange logs shards marked available or unavailable by the health checker.
+//
+func logRedisShardChange(name string) func(server string, available bool){
+	return func(server string, available bool){
+		tag := log.TAG_COM_REDIS_SHARD_DOWN
+		if available {
+			tag = log.TAG_COM_REDIS_SHARD_UP
+		}
+		log.Warn(context.Background(), tag, map[string]interface{}{
+			"pool": name,
+			"shard": server,
+		})
+	}
+}
+
+//
+// observeRedisCommand records command metrics, and logs slow commands with the trace of ctx.
+//
+func observeRedisCommand(ctx context.Context, info *redis.CommandInfo){
+	redisCommandDuration.Observe(info.Duration.Seconds(), info.Pool, info.Shard, info.Command)
+	if info.Err != nil {
+		redisCommandErrors.Inc(info.Pool, info.Shard, info.Command)
+	}
+	if !info.Slow {
+		return
+	}
+	parameter := map[string]interface{}{
+		"pool": info.Pool,
+		"shard": info.Shard,
+		"command": info.Command,
+		"key": info.Key,
+		"cost_time_us": info.Duration.Microseconds(),
+	}
+	if info.Err != nil {
+		parameter["err"] = info.Err.Error()
+	}
+	log.Warn(ctx, log.TAG_COM_REDIS_SLOW, parameter)
+}
+
 
 type RedisPoolConfig struct{
 	Name string
-	Dsn string
+	Dsn string //servers split by ";", or sentinels if MasterName is set
+	MasterName string //sentinel master name
+	SentinelPwd string
+	ReadFromReplicas bool //sentinel mode only, see RedisPool.GetReplica
+	Cluster bool //redis cluster, Dsn is the seed nodes
+	Weights []int //consistent hash weights aligned with Dsn servers
+	User string //acl username, redis 6+
 	Pwd string
 	Db int
+	SetName bool //CLIENT SETNAME with App.Name
+	Tls bool
+	TlsSkipVerify bool
 	MaxIdle int
 	MaxActive int
 	IdleTimeout ztime.Duration //idle timeout
+	Wait bool //wait for a connection when MaxActive is reached
+	WaitTimeout ztime.Duration //max wait time, 0 means until the context is done
+	TestOnBorrow bool //ping idle connections on borrow
+	TestIdleThreshold ztime.Duration //only ping connections idle longer than this
+	MaxFails int //failures in succession before a health check, 5 by default
+	CheckInterval ztime.Duration //health check interval of suspected shards, 3s by default
+	CheckTries int //connection attempts of a health check, 2 by default
+	MaxUnavailable float64 //max fraction of shards marked unavailable, 1/3 by default
 	ConnectTimeout ztime.Duration
 	ReadTimeout ztime.Duration //read timeout
 	WriteTimeout ztime.Duration //write timeout
+	Instrument bool //command metrics by pool, shard and command
+	SlowLog ztime.Duration //log commands slower than this when Instrument is set, 0 disables
 }
\ No newline at end of file
@@ -0,0 +1,298 @@
+// Package cache is a two-level cache-aside helper, with an in-process LRU
+// layer in front of a Redis layer shared by the instances.
+//
+//	users := cache.New(cache.Config{
+//		Redis:  zddgo.RedisDef(),
+//		Prefix: "user:",
+//		Codec:  cache.JSONCodec{New: func() interface{} { return new(User) }},
+//		InvalidateChannel: "user:invalidate",
+//	})
+//	v, err := users.GetOrLoad(ctx, "1", time.Minute, func(ctx context.Context) (interface{}, error) {
+//		return loadUser(ctx, 1)
+//	})
+//	u := v.(*User)
+package cache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/feekk/zddgo/redis"
+)
+
+// ErrNotFound is returned by loaders when the key has no value, the miss is
+// cached for Config.NegativeTTL and returned by GetOrLoad.
+var ErrNotFound = errors.New("cache: not found")
+
+// Loader loads the value of a key missing in both layers.
+type Loader func(ctx context.Context) (interface{}, error)
+
+// Values in Redis are prefixed by a flag, so that a cached miss is told
+// apart from any encoded value.
+const (
+	flagValue    = '+'
+	flagNotFound = '-'
+)
+
+type Config struct {
+	// Optional Redis layer shared by the instances, the cache is local only if nil
+	Redis *redis.RedisPool
+	// Prefix of the Redis keys, e.g. "user:"
+	Prefix string
+	// Codec of the values in Redis, JSONCodec{} by default
+	Codec Codec
+	// Maximum entries of the local layer, 10000 by default, negative disables it
+	LocalSize int
+	// Maximum time a value is kept locally, the ttl of GetOrLoad if shorter.
+	// It bounds staleness when invalidations are lost. 1 minute by default
+	LocalTTL time.Duration
+	// Time the misses of the loaders are cached, 10 seconds by default,
+	// negative disables it
+	NegativeTTL time.Duration
+	// Channel Set and Delete publish the keys on, so that the other instances
+	// drop their local copy. Empty disables it, it requires Redis
+	InvalidateChannel string
+	// Optional, called with the errors of the Redis layer, which are not
+	// returned as the loader is the source of truth
+	OnError func(key string, err error)
+}
+
+// Cache is safe for concurrent use. The values returned are shared by the
+// callers and must not be modified.
+type Cache struct {
+	conf  Config
+	local *lru
+	group group
+	// Identifies the invalidations of this instance
+	id  string
+	sub *redis.Subscriber
+}
+
+// New creates a cache, it subscribes the invalidation channel if any.
+func New(conf Config) *Cache {
+	if conf.Codec == nil {
+		conf.Codec = JSONCodec{}
+	}
+	if conf.LocalSize == 0 {
+		conf.LocalSize = 10000
+	}
+	if conf.LocalTTL <= 0 {
+		conf.LocalTTL = time.Minute
+	}
+	if conf.NegativeTTL == 0 {
+		conf.NegativeTTL = 10 * time.Second
+	}
+	c := &Cache{conf: conf, id: newID()}
+	if conf.LocalSize > 0 {
+		c.local = newLRU(conf.LocalSize)
+	}
+	if conf.Redis != nil && conf.InvalidateChannel != "" && c.local != nil {
+		c.sub = conf.Redis.NewSubscriber(redis.SubscriberConfig{})
+		c.sub.SubscribeFunc(conf.InvalidateChannel, c.invalidated)
+	}
+	return c
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// GetOrLoad returns the value of key from the local layer, or else from
+// Redis, or else from loader, caching it for ttl, forever if zero.
+// Concurrent misses of the same key share one load, with the ctx of the
+// first caller. ErrNotFound of loader is cached too, other errors are not.
+func (c *Cache) GetOrLoad(ctx context.Context, key string, ttl time.Duration, loader Loader) (interface{}, error) {
+	if e, ok := c.getLocal(key); ok {
+		return e.result()
+	}
+	return c.group.do(key, func() (interface{}, error) {
+		if e, ok := c.getRedis(ctx, key); ok {
+			if !e.notFound {
+				c.setLocal(e, ttl)
+			} else if c.conf.NegativeTTL > 0 {
+				c.setLocal(e, c.conf.NegativeTTL)
+			}
+			return e.result()
+		}
+
+		v, err := loader(ctx)
+		if err == ErrNotFound {
+			if c.conf.NegativeTTL > 0 {
+				e := &entry{key: key, notFound: true}
+				c.setRedis(ctx, e, c.conf.NegativeTTL)
+				c.setLocal(e, c.conf.NegativeTTL)
+			}
+			return nil, ErrNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		e := &entry{key: key, value: v}
+		c.setRedis(ctx, e, ttl)
+		c.setLocal(e, ttl)
+		return v, nil
+	})
+}
+
+// Set writes value to both layers, and invalidates the local copies of the
+// other instances.
+func (c *Cache) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	e := &entry{key: key, value: value}
+	if c.conf.Redis != nil {
+		data, err := c.encode(e)
+		if err != nil {
+			return err
+		}
+		if err = c.conf.Redis.Cmd().Set(ctx, c.conf.Prefix+key, data, ttl); err != nil {
+			return err
+		}
+	}
+	c.setLocal(e, ttl)
+	return c.publish(ctx, key)
+}
+
+// Delete removes keys from both layers, and invalidates the local copies of
+// the other instances.
+func (c *Cache) Delete(ctx context.Context, keys ...string) error {
+	for _, key := range keys {
+		// One by one, the keys may be on different shards
+		if c.conf.Redis != nil {
+			if _, err := c.conf.Redis.Cmd().Del(ctx, c.conf.Prefix+key); err != nil {
+				return err
+			}
+		}
+		if c.local != nil {
+			c.local.del(key)
+		}
+		if err := c.publish(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops receiving invalidations.
+func (c *Cache) Close() error {
+	if c.sub != nil {
+		return c.sub.Close()
+	}
+	return nil
+}
+
+func (e *entry) result() (interface{}, error) {
+	if e.notFound {
+		return nil, ErrNotFound
+	}
+	return e.value, nil
+}
+
+func (c *Cache) getLocal(key string) (*entry, bool) {
+	if c.local == nil {
+		return nil, false
+	}
+	return c.local.get(key)
+}
+
+// setLocal keeps a copy of e for ttl, bounded by LocalTTL.
+func (c *Cache) setLocal(e *entry, ttl time.Duration) {
+	if c.local == nil {
+		return
+	}
+	if ttl <= 0 || ttl > c.conf.LocalTTL {
+		ttl = c.conf.LocalTTL
+	}
+	local := *e
+	local.expireAt = time.Now().Add(ttl)
+	c.local.set(&local)
+}
+
+func (c *Cache) getRedis(ctx context.Context, key string) (*entry, bool) {
+	if c.conf.Redis == nil {
+		return nil, false
+	}
+	data, err := c.conf.Redis.Cmd().GetBytes(ctx, c.conf.Prefix+key)
+	if err != nil {
+		if err != redis.ErrNotFound {
+			c.onError(key, err)
+		}
+		return nil, false
+	}
+	e, err := c.decode(key, data)
+	if err != nil {
+		c.onError(key, err)
+		return nil, false
+	}
+	return e, true
+}
+
+func (c *Cache) setRedis(ctx context.Context, e *entry, ttl time.Duration) {
+	if c.conf.Redis == nil {
+		return
+	}
+	data, err := c.encode(e)
+	if err == nil {
+		err = c.conf.Redis.Cmd().Set(ctx, c.conf.Prefix+e.key, data, ttl)
+	}
+	if err != nil {
+		c.onError(e.key, err)
+	}
+}
+
+func (c *Cache) encode(e *entry) ([]byte, error) {
+	if e.notFound {
+		return []byte{flagNotFound}, nil
+	}
+	data, err := c.conf.Codec.Marshal(e.value)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{flagValue}, data...), nil
+}
+
+func (c *Cache) decode(key string, data []byte) (*entry, error) {
+	if len(data) == 0 {
+		return nil, errors.New("cache: empty value")
+	}
+	switch data[0] {
+	case flagNotFound:
+		return &entry{key: key, notFound: true}, nil
+	case flagValue:
+		v, err := c.conf.Codec.Unmarshal(data[1:])
+		if err != nil {
+			return nil, err
+		}
+		return &entry{key: key, value: v}, nil
+	}
+	return nil, errors.New("cache: unknown value flag")
+}
+
+func (c *Cache) onError(key string, err error) {
+	if c.conf.OnError != nil {
+		c.conf.OnError(key, err)
+	}
+}
+
+// publish invalidates the local copies of key in the other instances, the
+// message is "<instance id> <key>".
+func (c *Cache) publish(ctx context.Context, key string) error {
+	if c.conf.Redis == nil || c.conf.InvalidateChannel == "" {
+		return nil
+	}
+	_, err := c.conf.Redis.Publish(ctx, c.conf.InvalidateChannel, c.id+" "+key)
+	return err
+}
+
+// invalidated drops the local copy of a key published by another instance.
+func (c *Cache) invalidated(msg redis.Message) {
+	parts := strings.SplitN(string(msg.Data), " ", 2)
+	if len(parts) != 2 || parts[0] == c.id {
+		return
+	}
+	c.local.del(parts[1])
+}
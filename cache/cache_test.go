@@ -0,0 +1,190 @@
+package cache
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/feekk/zddgo/redis"
+	"github.com/feekk/zddgo/redis/redistest"
+)
+
+type user struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// newTestCache returns a cache of users on s, and a func closing it.
+func newTestCache(s *redistest.Server, conf Config) (*Cache, func()) {
+	p := redis.NewRedisPool([]string{s.Addr()}, redis.DefaultRedisPooledConnFactory, redis.DefaultPoolConfig)
+	conf.Redis = p
+	conf.Prefix = "user:"
+	conf.Codec = JSONCodec{New: func() interface{} { return new(user) }}
+	c := New(conf)
+	return c, func() {
+		c.Close()
+		p.Close()
+	}
+}
+
+func TestCacheGetOrLoad(t *testing.T) {
+	s := redistest.NewServer()
+	defer s.Close()
+	a, closeA := newTestCache(s, Config{})
+	defer closeA()
+	b, closeB := newTestCache(s, Config{})
+	defer closeB()
+
+	ctx := context.Background()
+	var loads int32
+	loader := func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt32(&loads, 1)
+		time.Sleep(20 * time.Millisecond)
+		return &user{ID: 1, Name: "tom"}, nil
+	}
+
+	// Concurrent misses share one load
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := a.GetOrLoad(ctx, "1", time.Minute, loader)
+			if err != nil || v.(*user).Name != "tom" {
+				t.Errorf("got %v %v", v, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if loads != 1 {
+		t.Errorf("loaded %d times", loads)
+	}
+	if _, ok := s.Get("user:1"); !ok {
+		t.Error("value not stored in redis")
+	}
+
+	// Another instance hits redis, then its local layer
+	s.FlushAll()
+	v, err := a.GetOrLoad(ctx, "1", time.Minute, loader)
+	if err != nil || v.(*user).Name != "tom" || loads != 1 {
+		t.Errorf("local miss %v %v %d", v, err, loads)
+	}
+	s.Set("user:1", `+{"id":1,"name":"jerry"}`)
+	v, err = b.GetOrLoad(ctx, "1", time.Minute, loader)
+	if err != nil || v.(*user).Name != "jerry" || loads != 1 {
+		t.Errorf("redis miss %v %v %d", v, err, loads)
+	}
+}
+
+func TestCacheNegative(t *testing.T) {
+	s := redistest.NewServer()
+	defer s.Close()
+	a, closeA := newTestCache(s, Config{})
+	defer closeA()
+	b, closeB := newTestCache(s, Config{NegativeTTL: -1})
+	defer closeB()
+
+	ctx := context.Background()
+	var loads int32
+	loader := func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt32(&loads, 1)
+		return nil, ErrNotFound
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := a.GetOrLoad(ctx, "404", time.Minute, loader); err != ErrNotFound {
+			t.Fatalf("got %v", err)
+		}
+	}
+	// The miss cached in redis is shared
+	if _, err := b.GetOrLoad(ctx, "404", time.Minute, loader); err != ErrNotFound || loads != 1 {
+		t.Errorf("got %v, loaded %d times", err, loads)
+	}
+
+	for i := 0; i < 2; i++ {
+		b.GetOrLoad(ctx, "405", time.Minute, loader)
+	}
+	if loads != 3 {
+		t.Errorf("miss cached with negative caching disabled, loaded %d times", loads)
+	}
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	s := redistest.NewServer()
+	defer s.Close()
+	conf := Config{InvalidateChannel: "user:invalidate"}
+	a, closeA := newTestCache(s, conf)
+	defer closeA()
+	b, closeB := newTestCache(s, conf)
+	defer closeB()
+
+	ctx := context.Background()
+	loader := func(ctx context.Context) (interface{}, error) {
+		return &user{ID: 2, Name: "old"}, nil
+	}
+	b.GetOrLoad(ctx, "2", time.Minute, loader)
+
+	// Wait for the subscriptions
+	for i := 0; s.Publish("user:invalidate", "- -") < 2; i++ {
+		if i > 100 {
+			t.Fatal("not subscribed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := a.Set(ctx, "2", &user{ID: 2, Name: "new"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		v, _ := b.GetOrLoad(ctx, "2", time.Minute, loader)
+		if v.(*user).Name == "new" {
+			break
+		}
+		if i > 100 {
+			t.Fatal("local copy not invalidated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := a.Delete(ctx, "2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Get("user:2"); ok {
+		t.Error("key not deleted in redis")
+	}
+}
+
+func TestLRU(t *testing.T) {
+	l := newLRU(2)
+	expireAt := time.Now().Add(time.Minute)
+	for i := 0; i < 3; i++ {
+		l.set(&entry{key: strconv.Itoa(i), value: i, expireAt: expireAt})
+		// Keep "0" recently used
+		l.get("0")
+	}
+	if _, ok := l.get("1"); ok || l.len() != 2 {
+		t.Errorf("least recently used not evicted, len %d", l.len())
+	}
+	if e, ok := l.get("0"); !ok || e.value != 0 {
+		t.Error("recently used evicted")
+	}
+	l.set(&entry{key: "0", value: 0, expireAt: time.Now()})
+	if _, ok := l.get("0"); ok || l.len() != 1 {
+		t.Error("expired entry returned")
+	}
+}
+
+func TestStringCodec(t *testing.T) {
+	var c StringCodec
+	data, err := c.Marshal("v")
+	if err != nil || string(data) != "v" {
+		t.Errorf("Marshal = %q, %v", data, err)
+	}
+	if _, err = c.Marshal(1); err == nil {
+		t.Error("marshaled an int")
+	}
+	if v, err := c.Unmarshal(data); err != nil || v != "v" {
+		t.Errorf("Unmarshal = %v, %v", v, err)
+	}
+}
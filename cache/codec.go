@@ -0,0 +1,53 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Codec serializes the values stored in Redis. Unmarshal must return values
+// of the type the loaders return, so that callers see the same type on hits
+// of either layer.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte) (interface{}, error)
+}
+
+// JSONCodec encodes values as JSON. New returns the pointer to decode into,
+// e.g. func() interface{} { return new(User) }, so the loaders should return
+// *User too. Values are decoded into interface{} if New is nil.
+type JSONCodec struct {
+	New func() interface{}
+}
+
+func (c JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (c JSONCodec) Unmarshal(data []byte) (interface{}, error) {
+	var v interface{}
+	if c.New == nil {
+		err := json.Unmarshal(data, &v)
+		return v, err
+	}
+	v = c.New()
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// StringCodec stores string values as they are, Marshal fails on other types.
+type StringCodec struct{}
+
+func (StringCodec) Marshal(v interface{}) ([]byte, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("cache: StringCodec cannot marshal %T", v)
+	}
+	return []byte(s), nil
+}
+
+func (StringCodec) Unmarshal(data []byte) (interface{}, error) {
+	return string(data), nil
+}
@@ -0,0 +1,49 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+)
+
+var errLoadPanicked = errors.New("cache: loader panicked")
+
+// call is a load in flight.
+type call struct {
+	wg  sync.WaitGroup
+	val interface{}
+	err error
+}
+
+// group collapses concurrent loads of the same key into one, as singleflight.
+type group struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+// do runs fn once for the concurrent callers of key, which share its result.
+func (g *group) do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.val, c.err
+	}
+	c := &call{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		c.wg.Done()
+	}()
+	// Seen by the waiters if fn panics
+	c.err = errLoadPanicked
+	c.val, c.err = fn()
+	return c.val, c.err
+}
@@ -0,0 +1,68 @@
+package zddgo
+
+import(
+	"context"
+	"sync"
+	"testing"
+	"time"
+	"github.com/feekk/zddgo/redis"
+	"github.com/feekk/zddgo/redis/redistest"
+)
+
+func TestRedisInit(t *testing.T){
+	def := redistest.NewServer()
+	defer def.Close()
+	def.RequirePassword("redispwd")
+	other := redistest.NewServer()
+	defer other.Close()
+
+	oldDef, oldOthers := defaultConn, otherConns
+	defer func(){ defaultConn, otherConns = oldDef, oldOthers }()
+	otherConns = &sync.Map{}
+
+	err := RedisInit(&RedisConf{
+		Use: true,
+		Default: RedisPoolConfig{Dsn: def.Addr(), Pwd: "redispwd", MaxIdle: 2},
+		Connection: []RedisPoolConfig{{Name: "other", Dsn: other.Addr(), Db: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RedisDef().Close()
+
+	ctx := context.Background()
+	cmd := RedisDef().Cmd()
+	if err = cmd.Set(ctx, "user:1", "tom", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := def.Get("user:1"); v != "tom" {
+		t.Errorf("default pool wrote %q", v)
+	}
+	if _, err = cmd.Get(ctx, "user:2"); err != redis.ErrNotFound {
+		t.Errorf("missing key: %v", err)
+	}
+	if _, err = cmd.HSet(ctx, "h", "f", 1); err != nil {
+		t.Error(err)
+	}
+	if n, _ := cmd.HIncrBy(ctx, "h", "f", 2); n != 3 {
+		t.Errorf("hincrby %d", n)
+	}
+
+	p, ok := RedisConn("other")
+	if !ok {
+		t.Fatal("named pool not found")
+	}
+	defer p.Close()
+	if n, err := p.Cmd().Incr(ctx, "n"); err != nil || n != 1 {
+		t.Errorf("incr %d %v", n, err)
+	}
+	//Db 1 of the named pool
+	if _, ok = other.Get("n"); ok {
+		t.Error("key written in db 0")
+	}
+
+	//wrong password fails the startup check
+	if _, err = NewRedisPool(&RedisPoolConfig{Dsn: def.Addr(), Pwd: "wrong"}); err == nil {
+		t.Error("pool created with wrong password")
+	}
+}
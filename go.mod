@@ -10,4 +10,5 @@ require (
 	github.com/jinzhu/gorm v1.9.11
 	github.com/kr/pretty v0.1.0 // indirect
 	github.com/pkg/errors v0.8.1
+	golang.org/x/net v0.0.0-20190311183353-d8887717615a
 )
@@ -2,32 +2,160 @@ package zddgo
 
 import(
 	"io"
+	"net"
 	"net/http"
-	"fmt"
+	"os"
 	"time"
 	"strconv"
 	"context"
+	"sync"
+	"crypto/tls"
+	"syscall"
 	"github.com/feekk/zddgo/ztime"
-	"github.com/feekk/zddgo/trace"
+	"github.com/feekk/zddgo/errors"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 
 func NewHttpSvr(c *HttpSvrConfig, handler http.Handler) (svr *http.Server){
+	if c.H2c && !c.isTLS() {
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
 	svr = &http.Server{
-		Addr:           fmt.Sprintf(":%s", strconv.Itoa(c.Port)),
+		Addr:           net.JoinHostPort(c.Host, strconv.Itoa(c.Port)),
 		Handler:        handler,
 		ReadTimeout:    time.Duration(c.ReadTimeout),
+		ReadHeaderTimeout: time.Duration(c.ReadHeaderTimeout),
 		WriteTimeout:   time.Duration(c.WriteTimeout),
+		IdleTimeout:    time.Duration(c.IdleTimeout),
 		MaxHeaderBytes: c.MaxHeaderBytes, //1 << 20 
 	}
+	if c.isTLS() {
+		reloader := &certReloader{certFile: c.CertFile, keyFile: c.KeyFile}
+		svr.TLSConfig = &tls.Config{GetCertificate: reloader.GetCertificate}
+	}
 	return
 }
 
+//
+// ServeHttpSvr listens as c describes and serves svr built by NewHttpSvr, TLS is
+// served when cert and key files are configured.
+//
+func ServeHttpSvr(c *HttpSvrConfig, svr *http.Server) (err error){
+	l, err := c.Listen()
+	if err != nil {
+		return
+	}
+	if c.isTLS() {
+		return svr.ServeTLS(l, "", "")
+	}
+	return svr.Serve(l)
+}
+
 type HttpSvrConfig struct{
+	Host string //bind host, empty means all interfaces
 	Port int
+	Unix string //unix socket path, takes precedence over Host and Port
 	ReadTimeout ztime.Duration
+	ReadHeaderTimeout ztime.Duration
 	WriteTimeout ztime.Duration
+	IdleTimeout ztime.Duration
 	MaxHeaderBytes int
+	CertFile string //tls cert file, reloaded when modified
+	KeyFile string //tls key file
+	H2c bool //serve HTTP/2 without tls, HTTP/2 over tls is always on
+	Admin *HttpSvrConfig //additional admin listener
+}
+
+func(c *HttpSvrConfig) isTLS() bool{
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+func(c *HttpSvrConfig) Listen() (l net.Listener, err error){
+	if c.Unix != "" {
+		// remove the socket file left by the last run, never another kind of file
+		// nor a socket a live process still listens on
+		if fi, serr := os.Lstat(c.Unix); serr == nil && fi.Mode()&os.ModeSocket != 0 {
+			conn, derr := net.Dial("unix", c.Unix)
+			if derr == nil {
+				conn.Close()
+				return nil, errors.Errorf("listen unix %s: address already in use", c.Unix)
+			}
+			if isConnRefused(derr) {
+				os.Remove(c.Unix)
+			}
+		}
+		l, err = net.Listen("unix", c.Unix)
+	} else {
+		l, err = net.Listen("tcp", net.JoinHostPort(c.Host, strconv.Itoa(c.Port)))
+	}
+	err = errors.With(err)
+	return
+}
+
+func isConnRefused(err error) bool{
+	if oe, ok := err.(*net.OpError); ok {
+		if se, ok := oe.Err.(*os.SyscallError); ok {
+			return se.Err == syscall.ECONNREFUSED
+		}
+	}
+	return false
+}
+
+//
+// certReloader loads the key pair again once the cert or key file is modified.
+//
+type certReloader struct{
+	mu sync.Mutex
+	certFile string
+	keyFile string
+	cert *tls.Certificate
+	modTime time.Time
+	checkedAt time.Time
+}
+
+func(r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error){
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if r.cert != nil && now.Sub(r.checkedAt) < time.Second {
+		return r.cert, nil
+	}
+	r.checkedAt = now
+	modTime, err := r.lastModified()
+	if err != nil {
+		if r.cert != nil {
+			return r.cert, nil
+		}
+		return nil, err
+	}
+	if r.cert != nil && !modTime.After(r.modTime) {
+		return r.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		// keep serving the old pair while files are half written
+		if r.cert != nil {
+			return r.cert, nil
+		}
+		return nil, errors.With(err)
+	}
+	r.cert, r.modTime = &cert, modTime
+	return r.cert, nil
+}
+
+func(r *certReloader) lastModified() (t time.Time, err error){
+	for _, file := range []string{r.certFile, r.keyFile} {
+		fi, serr := os.Stat(file)
+		if serr != nil {
+			return t, errors.With(serr)
+		}
+		if fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return
 }
 
 //
@@ -38,6 +166,7 @@ func NewHttpRequest(ctx context.Context) (c *HttpRequest){
 		ctx : ctx,
 		client : &http.Client{},
 		header : make(http.Header),
+		interceptors : []Interceptor{TraceInterceptor(), MetricsInterceptor()},
 	}
 	return
 }
@@ -45,28 +174,46 @@ type HttpRequest struct{
 	ctx context.Context
 	client *http.Client
 	header http.Header
+	interceptors []Interceptor
 }
 func(r *HttpRequest) SetHeader(name, value string) {
 	r.header.Add(name, value)
 }
+//
+// Use appends interceptors to the chain, the default chain holds TraceInterceptor and MetricsInterceptor.
+//
+func(r *HttpRequest) Use(interceptors ...Interceptor) {
+	r.interceptors = append(r.interceptors, interceptors...)
+}
+//
+// SetInterceptors replaces the whole chain, so the built-in ones can be reordered or dropped.
+//
+func(r *HttpRequest) SetInterceptors(interceptors ...Interceptor) {
+	r.interceptors = interceptors
+}
 
 func(r *HttpRequest) Get(url string)(resp *http.Response, err error){
 	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return
+	}
 	return r.do(req)
 }
 func(r *HttpRequest) Post(url, contentType string, body io.Reader)(resp *http.Response, err error){
 	req, err := http.NewRequest(http.MethodPost, url, body)
-	r.SetHeader("Content-Type", contentType)
+	if err != nil {
+		return
+	}
+	//only this request, r.header is shared by the later ones
+	req.Header.Set("Content-Type", contentType)
 	return r.do(req)
 }
 func(r *HttpRequest) do(req *http.Request) (resp *http.Response, err error){
-	t := trace.InheritContextTrace(r.ctx)
-	req.Header = r.header.Clone()
-	if t != nil {
-		t.IncrRpc()
-		traceId, spanId, _, _, _, _ := t.Get()
-		req.Header.Set(trace.GetTraceHeadKey(), traceId)
-		req.Header.Set(trace.GetSpandHeadKey(), spanId)
-	}
-	return r.client.Do(req)
-}
\ No newline at end of file
+	req = req.WithContext(r.ctx)
+	header := r.header.Clone()
+	for name, values := range req.Header {
+		header[name] = values
+	}
+	req.Header = header
+	return chain(r.interceptors, r.client.Do)(req)
+}
@@ -0,0 +1,151 @@
+package zddgo
+
+import(
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"github.com/feekk/zddgo/errors"
+)
+
+var(
+	ErrDownloadTooLarge = errors.New("http: download exceeds max size")
+)
+
+//
+// PostForm posts data url-encoded.
+//
+func(r *HttpRequest) PostForm(url string, data url.Values)(resp *http.Response, err error){
+	return r.Post(url, "application/x-www-form-urlencoded", strings.NewReader(data.Encode()))
+}
+
+//
+// PostMultipart posts form as multipart/form-data, files are streamed from their readers.
+//
+func(r *HttpRequest) PostMultipart(url string, form *MultipartForm)(resp *http.Response, err error){
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func(){
+		pw.CloseWithError(form.writeTo(mw))
+	}()
+	resp, err = r.Post(url, mw.FormDataContentType(), pr)
+	pr.Close()
+	return
+}
+
+func NewMultipartForm() *MultipartForm{
+	return &MultipartForm{}
+}
+
+//
+// MultipartForm holds fields and files in the order added.
+//
+type MultipartForm struct{
+	parts []multipartPart
+}
+type multipartPart struct{
+	field string
+	value string
+	filename string
+	reader io.Reader
+}
+func(f *MultipartForm) AddField(field, value string) *MultipartForm{
+	f.parts = append(f.parts, multipartPart{field: field, value: value})
+	return f
+}
+func(f *MultipartForm) AddFile(field, filename string, reader io.Reader) *MultipartForm{
+	f.parts = append(f.parts, multipartPart{field: field, filename: filename, reader: reader})
+	return f
+}
+func(f *MultipartForm) writeTo(mw *multipart.Writer) (err error){
+	for _, part := range f.parts {
+		if part.reader == nil {
+			err = mw.WriteField(part.field, part.value)
+		} else {
+			var w io.Writer
+			if w, err = mw.CreateFormFile(part.field, part.filename); err == nil {
+				_, err = io.Copy(w, part.reader)
+			}
+		}
+		if err != nil {
+			return errors.With(err)
+		}
+	}
+	return errors.With(mw.Close())
+}
+
+//
+// DownloadOption controls Download, zero value means no limit and no progress.
+//
+type DownloadOption struct{
+	// Abort with ErrDownloadTooLarge once more than MaxSize bytes are received
+	MaxSize int64
+	// Called after every write with bytes written so far and Content-Length, -1 if unknown
+	Progress func(written, total int64)
+}
+
+//
+// Download streams the body of url into w.
+//
+func(r *HttpRequest) Download(url string, w io.Writer, opt DownloadOption) (written int64, err error){
+	resp, err := r.Get(url)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err = errors.Errorf("http: download %s status %d", url, resp.StatusCode)
+		return
+	}
+	if opt.MaxSize > 0 && resp.ContentLength > opt.MaxSize {
+		err = ErrDownloadTooLarge
+		return
+	}
+	dst := &progressWriter{w: w, total: resp.ContentLength, max: opt.MaxSize, progress: opt.Progress}
+	written, err = io.Copy(dst, resp.Body)
+	if err != ErrDownloadTooLarge {
+		err = errors.With(err)
+	}
+	return
+}
+
+//
+// DownloadFile downloads url into path, a partial file is removed on failure.
+//
+func(r *HttpRequest) DownloadFile(url, path string, opt DownloadOption) (written int64, err error){
+	f, err := os.Create(path)
+	if err != nil {
+		err = errors.With(err)
+		return
+	}
+	written, err = r.Download(url, f, opt)
+	if cerr := f.Close(); err == nil && cerr != nil {
+		err = errors.With(cerr)
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return
+}
+
+type progressWriter struct{
+	w io.Writer
+	written int64
+	total int64
+	max int64
+	progress func(written, total int64)
+}
+func(p *progressWriter) Write(b []byte) (n int, err error){
+	if p.max > 0 && p.written + int64(len(b)) > p.max {
+		return 0, ErrDownloadTooLarge
+	}
+	n, err = p.w.Write(b)
+	p.written += int64(n)
+	if p.progress != nil {
+		p.progress(p.written, p.total)
+	}
+	return
+}
+
@@ -0,0 +1,135 @@
+package zddgo
+
+import(
+	"net/http"
+	"strconv"
+	"time"
+	"github.com/feekk/zddgo/log"
+	"github.com/feekk/zddgo/metrics"
+	"github.com/feekk/zddgo/trace"
+)
+
+var(
+	httpClientDuration = metrics.NewHistogram("http_client_request_duration_seconds", "Outbound http call latency by host and status.", nil, "method", "host", "status")
+)
+
+//
+// RoundTrip sends req and returns the response, it is the tail of an interceptor chain.
+//
+type RoundTrip func(req *http.Request) (*http.Response, error)
+
+//
+// Interceptor wraps an outbound call, it may change req, call next zero or
+// more times and change the returned response.
+//
+type Interceptor func(req *http.Request, next RoundTrip) (*http.Response, error)
+
+//
+// chain builds the RoundTrip running interceptors in order, the first one is the outermost.
+//
+func chain(interceptors []Interceptor, last RoundTrip) RoundTrip{
+	rt := last
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], rt
+		rt = func(req *http.Request) (*http.Response, error){
+			return interceptor(req, next)
+		}
+	}
+	return rt
+}
+
+//
+// TraceInterceptor injects trace and span id of the request context into the header.
+//
+func TraceInterceptor() Interceptor{
+	return func(req *http.Request, next RoundTrip) (*http.Response, error){
+		if t := trace.InheritContextTrace(req.Context()); t != nil {
+			t.IncrRpc()
+			traceId, spanId, _, _, _, _ := t.Get()
+			req.Header.Set(trace.GetTraceHeadKey(), traceId)
+			req.Header.Set(trace.GetSpandHeadKey(), spanId)
+		}
+		return next(req)
+	}
+}
+
+//
+// LogInterceptor logs every outbound call with its status and cost.
+//
+func LogInterceptor() Interceptor{
+	return func(req *http.Request, next RoundTrip) (*http.Response, error){
+		start := time.Now()
+		resp, err := next(req)
+		parameter := map[string]interface{}{
+			"method": req.Method,
+			"url": req.URL.String(),
+			"cost_time_us": time.Now().Sub(start).Microseconds(),
+		}
+		if err != nil {
+			parameter["err"] = err
+			log.Warn(req.Context(), log.TAG_COM_HTTP_FAILURE, parameter)
+			return resp, err
+		}
+		parameter["http_status"] = resp.StatusCode
+		log.Info(req.Context(), log.TAG_COM_HTTP_SUCCESS, parameter)
+		return resp, err
+	}
+}
+
+//
+// MetricsInterceptor observes the latency of outbound calls, status is "error" if no response.
+//
+func MetricsInterceptor() Interceptor{
+	return func(req *http.Request, next RoundTrip) (*http.Response, error){
+		start := time.Now()
+		resp, err := next(req)
+		status := "error"
+		if err == nil {
+			status = strconv.Itoa(resp.StatusCode)
+		}
+		httpClientDuration.Observe(time.Now().Sub(start).Seconds(), req.Method, req.URL.Host, status)
+		return resp, err
+	}
+}
+
+//
+// RetryInterceptor retries a failed call at most maxRetry times, waiting backoff between tries.
+// A call is failed if an error is returned or the status is 5xx. Requests with a body
+// are only retried when the body can be rewound by req.GetBody.
+//
+func RetryInterceptor(maxRetry int, backoff time.Duration) Interceptor{
+	return func(req *http.Request, next RoundTrip) (resp *http.Response, err error){
+		for tries := 0; ; tries++ {
+			resp, err = next(req)
+			if err == nil && resp.StatusCode < http.StatusInternalServerError {
+				return
+			}
+			if tries >= maxRetry || !rewind(req) {
+				return
+			}
+			if resp != nil {
+				resp.Body.Close()
+			}
+			select {
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			case <-time.After(backoff):
+			}
+		}
+	}
+}
+
+func rewind(req *http.Request) bool{
+	if req.Body == nil || req.Body == http.NoBody {
+		return true
+	}
+	if req.GetBody == nil {
+		return false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return false
+	}
+	req.Body = body
+	return true
+}
@@ -0,0 +1,296 @@
+package zddgo
+
+import(
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"github.com/feekk/zddgo/trace"
+	"golang.org/x/net/http2"
+)
+
+func TestHttpRequestInterceptor(t *testing.T){
+	var calls int32
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("X-Trace", r.Header.Get(trace.GetTraceHeadKey()))
+		w.Header().Set("X-Sign", r.Header.Get("X-Sign"))
+	}))
+	defer svr.Close()
+
+	ctx := context.WithValue(context.Background(), trace.TraceContextKey, trace.NewTrace())
+	r := NewHttpRequest(ctx)
+	var order []string
+	r.Use(func(req *http.Request, next RoundTrip) (*http.Response, error){
+		order = append(order, "sign")
+		req.Header.Set("X-Sign", "signed")
+		return next(req)
+	}, RetryInterceptor(2, 0))
+
+	resp, err := r.Post(svr.URL, "text/plain", strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || atomic.LoadInt32(&calls) != 3 {
+		t.Errorf("status=%d calls=%d", resp.StatusCode, calls)
+	}
+	if resp.Header.Get("X-Trace") == "" || resp.Header.Get("X-Sign") != "signed" {
+		t.Errorf("header not injected: %v", resp.Header)
+	}
+	if len(order) != 1 {
+		t.Errorf("interceptor before retry called %d times", len(order))
+	}
+}
+
+func TestHttpRequestMultipartAndDownload(t *testing.T){
+	var contentTypes []string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
+		contentTypes = append(contentTypes, strings.Join(r.Header["Content-Type"], ","))
+		if r.Method == http.MethodGet {
+			w.Write(bytes.Repeat([]byte("x"), 1024))
+			return
+		}
+		if r.FormValue("form") != "" {
+			return
+		}
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		data, _ := ioutil.ReadAll(file)
+		w.Write([]byte(r.FormValue("name") + ":" + header.Filename + ":" + string(data)))
+	}))
+	defer svr.Close()
+
+	r := NewHttpRequest(context.Background())
+	form := NewMultipartForm().AddField("name", "zddgo").AddFile("file", "a.txt", strings.NewReader("content"))
+	resp, err := r.PostMultipart(svr.URL, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "zddgo:a.txt:content" {
+		t.Errorf("multipart body %q", body)
+	}
+
+	var buf bytes.Buffer
+	var last int64
+	n, err := r.Download(svr.URL, &buf, DownloadOption{Progress: func(written, total int64){ last = written }})
+	if err != nil || n != 1024 || last != 1024 {
+		t.Errorf("download n=%d last=%d err=%v", n, last, err)
+	}
+	if _, err = r.Download(svr.URL, ioutil.Discard, DownloadOption{MaxSize: 100}); err != ErrDownloadTooLarge {
+		t.Errorf("download limit err=%v", err)
+	}
+	if resp, err = r.PostForm(svr.URL, url.Values{"form": {"1"}}); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	// Content-Type is not kept by the reused HttpRequest
+	if len(contentTypes) != 4 || contentTypes[1] != "" || contentTypes[2] != "" || contentTypes[3] != "application/x-www-form-urlencoded" {
+		t.Errorf("content types %q", contentTypes)
+	}
+}
+
+func TestServeHttpSvrUnix(t *testing.T){
+	dir, err := ioutil.TempDir("", "zddgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := &HttpSvrConfig{Unix: filepath.Join(dir, "zddgo.sock")}
+	svr := NewHttpSvr(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
+		w.Write([]byte("pong"))
+	}))
+	go ServeHttpSvr(c, svr)
+	defer svr.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error){
+			var d net.Dialer
+			for i := 0; ; i++ {
+				conn, err := d.DialContext(ctx, "unix", c.Unix)
+				if err == nil || i > 100 {
+					return conn, err
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		},
+	}}
+	resp, err := client.Get("http://unix/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "pong" {
+		t.Errorf("body %q", body)
+	}
+}
+
+func TestHttpSvrListenUnixKeepsFile(t *testing.T){
+	dir, err := ioutil.TempDir("", "zddgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := &HttpSvrConfig{Unix: filepath.Join(dir, "data")}
+	if err = ioutil.WriteFile(c.Unix, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := c.Listen(); err == nil {
+		l.Close()
+		t.Fatal("listened on a regular file")
+	}
+	if data, err := ioutil.ReadFile(c.Unix); err != nil || string(data) != "data" {
+		t.Errorf("regular file removed, %q %v", data, err)
+	}
+
+	// A socket left by the last run is replaced
+	c.Unix = filepath.Join(dir, "zddgo.sock")
+	l, err := net.Listen("unix", c.Unix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keep the file as a crashed process would
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	if l, err = c.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// A socket a live listener holds is kept
+	if l2, err := c.Listen(); err == nil {
+		l2.Close()
+		t.Fatal("listened on a live socket")
+	}
+	conn, err := net.Dial("unix", c.Unix)
+	if err != nil {
+		t.Fatalf("live socket removed, %v", err)
+	}
+	conn.Close()
+}
+
+// writeCertPair writes a self-signed pair of serial to certFile and keyFile.
+func writeCertPair(t *testing.T, certFile, keyFile string, serial int64){
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject: pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Later than the last pair, whatever the resolution of the file system
+	modTime := time.Now().Add(time.Duration(serial) * time.Second)
+	os.Chtimes(certFile, modTime, modTime)
+	os.Chtimes(keyFile, modTime, modTime)
+}
+
+func TestHttpSvrTLSReload(t *testing.T){
+	dir, err := ioutil.TempDir("", "zddgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := &HttpSvrConfig{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+	writeCertPair(t, c.CertFile, c.KeyFile, 1)
+	svr := NewHttpSvr(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
+		w.Write([]byte(r.Proto))
+	}))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go svr.ServeTLS(l, "", "")
+	defer svr.Close()
+
+	serial := func() int64 {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	if n := serial(); n != 1 {
+		t.Fatalf("serial %d", n)
+	}
+	writeCertPair(t, c.CertFile, c.KeyFile, 2)
+	// Files are checked once a second at most
+	time.Sleep(1100 * time.Millisecond)
+	if n := serial(); n != 2 {
+		t.Errorf("cert not reloaded, serial %d", n)
+	}
+}
+
+func TestHttpSvrH2c(t *testing.T){
+	c := &HttpSvrConfig{H2c: true}
+	svr := NewHttpSvr(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
+		w.Write([]byte(r.Proto))
+	}))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go svr.Serve(l)
+	defer svr.Close()
+
+	// HTTP/2 with prior knowledge over plain tcp
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error){
+			return net.Dial(network, addr)
+		},
+	}}
+	resp, err := client.Get("http://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "HTTP/2.0" {
+		t.Errorf("proto %q", body)
+	}
+}
@@ -15,6 +15,15 @@ const(
 	TAG_COM_REQUEST_IN = "_com_request_in"
 	//http request out
 	TAG_COM_REQUEST_OUT = "_com_request_out"
+	//outbound http call success
+	TAG_COM_HTTP_SUCCESS = "_com_http_success"
+	//outbound http call failure
+	TAG_COM_HTTP_FAILURE = "_com_http_failure"
+	//redis command slower than the pool SlowLog
+	TAG_COM_REDIS_SLOW = "_com_redis_slow"
+	//redis shard marked available or unavailable by the health checker
+	TAG_COM_REDIS_SHARD_UP = "_com_redis_shard_up"
+	TAG_COM_REDIS_SHARD_DOWN = "_com_redis_shard_down"
 	//
 	TAG_Status_Internal_Server_BrokenPipe = "_status_internal_server_brokenpipe"
 	// 
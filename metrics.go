@@ -0,0 +1,87 @@
+package zddgo
+
+import(
+	"github.com/jinzhu/gorm"
+	"github.com/feekk/zddgo/metrics"
+	"github.com/feekk/zddgo/redis"
+)
+
+var(
+	redisPoolAvailable = metrics.NewGauge("redis_pool_available", "Whether the redis shard is available.", "pool", "shard")
+	redisPoolActive = metrics.NewGauge("redis_pool_active_connections", "Active connections of the redis shard.", "pool", "shard")
+	redisPoolIdle = metrics.NewGauge("redis_pool_idle_connections", "Idle connections of the redis shard.", "pool", "shard")
+	redisPoolWaiting = metrics.NewGauge("redis_pool_waiting", "Borrows waiting for a connection of the redis shard.", "pool", "shard")
+	redisPoolFailStreak = metrics.NewGauge("redis_pool_fail_streak", "Failures in succession of the redis shard.", "pool", "shard")
+	redisPoolLastCheck = metrics.NewGauge("redis_pool_last_check_timestamp_seconds", "Unix time of the last health check of the redis shard.", "pool", "shard")
+	redisPoolOps = metrics.NewCounter("redis_pool_operations_total", "Redis shard pool operations by kind, e.t. get, put, dial.", "pool", "shard", "op")
+	redisPoolWaitSeconds = metrics.NewCounter("redis_pool_wait_duration_seconds_total", "Total time waited for a connection of the redis shard.", "pool", "shard")
+	redisCommandDuration = metrics.NewHistogram("redis_command_duration_seconds", "Redis command latency by pool, shard and command.", nil, "pool", "shard", "command")
+	redisCommandErrors = metrics.NewCounter("redis_command_errors_total", "Redis commands failed by pool, shard and command.", "pool", "shard", "command")
+
+	mysqlOpen = metrics.NewGauge("mysql_open_connections", "Established connections both in use and idle.", "db")
+	mysqlInUse = metrics.NewGauge("mysql_in_use_connections", "Connections currently in use.", "db")
+	mysqlIdle = metrics.NewGauge("mysql_idle_connections", "Idle connections.", "db")
+	mysqlWaitCount = metrics.NewCounter("mysql_wait_total", "Total connections waited for.", "db")
+	mysqlWaitSeconds = metrics.NewCounter("mysql_wait_duration_seconds_total", "Total time blocked waiting for a new connection.", "db")
+)
+
+func init(){
+	metrics.RegisterCollector(collectRedisPools)
+	metrics.RegisterCollector(collectMysql)
+}
+
+//
+// collectRedisPools copies the stats of every shard of the redis pools, the cumulative
+// counters of GetPoolStats are copied as is.
+//
+func collectRedisPools(){
+	for _, g := range []*metrics.Gauge{redisPoolAvailable, redisPoolActive, redisPoolIdle, redisPoolWaiting, redisPoolFailStreak, redisPoolLastCheck} {
+		g.Reset()
+	}
+	rangeRedis(func(name string, pool *redis.RedisPool){
+		for _, s := range pool.GetPoolStats() {
+			available := 0.0
+			if s.Available {
+				available = 1
+			}
+			redisPoolAvailable.Set(available, name, s.Shard)
+			redisPoolActive.Set(float64(s.NumActive), name, s.Shard)
+			redisPoolIdle.Set(float64(s.NumIdle), name, s.Shard)
+			redisPoolWaiting.Set(float64(s.NumWaiting), name, s.Shard)
+			redisPoolFailStreak.Set(float64(s.FailStreak), name, s.Shard)
+			if !s.LastCheck.IsZero() {
+				redisPoolLastCheck.Set(float64(s.LastCheck.UnixNano())/1e9, name, s.Shard)
+			}
+			for op, n := range map[string]uint64{
+				"get": s.NumGet,
+				"put": s.NumPut,
+				"broken": s.NumBroken,
+				"dial": s.NumDial,
+				"dial_error": s.NumDialError,
+				"evict": s.NumEvict,
+				"close": s.NumClose,
+				"wait": s.NumWait,
+				"wait_timeout": s.NumWaitTimeout,
+				"test": s.NumTest,
+				"test_failed": s.NumTestFailed,
+			} {
+				redisPoolOps.Set(float64(n), name, s.Shard, op)
+			}
+			redisPoolWaitSeconds.Set(s.WaitDuration.Seconds(), name, s.Shard)
+		}
+	})
+}
+
+//
+// sql.DBStats WaitCount and WaitDuration are cumulative, copied as counters.
+//
+func collectMysql(){
+	rangeMysql(func(name string, db *gorm.DB){
+		s := db.DB().Stats()
+		mysqlOpen.Set(float64(s.OpenConnections), name)
+		mysqlInUse.Set(float64(s.InUse), name)
+		mysqlIdle.Set(float64(s.Idle), name)
+		mysqlWaitCount.Set(float64(s.WaitCount), name)
+		mysqlWaitSeconds.Set(s.WaitDuration.Seconds(), name)
+	})
+}
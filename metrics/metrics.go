@@ -0,0 +1,374 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Default histogram buckets in seconds, same as the Prometheus client.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// DefaultRegistry is used by the package level constructors and Handler.
+var DefaultRegistry = NewRegistry()
+
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+// Registry holds metrics and collectors to be exposed.
+type Registry struct {
+	mu         sync.Mutex
+	metrics    map[string]metric
+	collectors []func()
+
+	// Serializes expositions, so that one never writes the gauges another
+	// one's collectors have reset and not refilled yet
+	scrape sync.Mutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.metrics[m.name()]; ok {
+		panic(fmt.Sprintf("metrics: duplicate metric %s", m.name()))
+	}
+	r.metrics[m.name()] = m
+}
+
+// RegisterCollector adds a function called before each exposition,
+// it is used to refresh gauges from other sources, e.t. pool stats.
+func (r *Registry) RegisterCollector(f func()) {
+	r.mu.Lock()
+	r.collectors = append(r.collectors, f)
+	r.mu.Unlock()
+}
+
+// WriteText writes all metrics in the Prometheus text format, sorted by name.
+func (r *Registry) WriteText(w io.Writer) {
+	r.scrape.Lock()
+	defer r.scrape.Unlock()
+	r.mu.Lock()
+	collectors := make([]func(), len(r.collectors))
+	copy(collectors, r.collectors)
+	metrics := make([]metric, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		metrics = append(metrics, m)
+	}
+	r.mu.Unlock()
+
+	for _, f := range collectors {
+		f()
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name() < metrics[j].name() })
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// Handler serves the registry in the Prometheus text format.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteText(w)
+	})
+}
+
+func RegisterCollector(f func()) {
+	DefaultRegistry.RegisterCollector(f)
+}
+
+func Handler() http.Handler {
+	return DefaultRegistry.Handler()
+}
+
+// desc is the common part of all metric types
+type desc struct {
+	fqName string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) name() string {
+	return d.fqName
+}
+
+func (d *desc) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.fqName, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.fqName, d.typ)
+}
+
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.fqName, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelString formats {k="v",...}, extra pair is appended when not empty, e.t. le for histograms.
+func (d *desc) labelString(values []string, extraKey, extraValue string) string {
+	if len(values) == 0 && extraKey == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, l := range d.labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", l, escapeLabel(values[i]))
+	}
+	if extraKey != "" {
+		if len(values) > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", extraKey, extraValue)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+type sample struct {
+	values []string
+	v      float64
+}
+
+// Counter is a monotonically increasing value per label set.
+type Counter struct {
+	desc
+	mu      sync.Mutex
+	samples map[string]*sample
+}
+
+// NewCounter creates a counter and registers it on DefaultRegistry.
+func NewCounter(name, help string, labels ...string) *Counter {
+	return DefaultRegistry.NewCounter(name, help, labels...)
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		desc:    desc{fqName: name, help: help, typ: "counter", labels: labels},
+		samples: make(map[string]*sample),
+	}
+	r.register(c)
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increases the counter, negative v panics.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+	c.update(labelValues, func(s *sample) { s.v += v })
+}
+
+// Set sets the counter to a cumulative value counted elsewhere, e.g. by a
+// collector. The value only goes back when its source restarts.
+func (c *Counter) Set(v float64, labelValues ...string) {
+	c.update(labelValues, func(s *sample) { s.v = v })
+}
+
+func (c *Counter) update(labelValues []string, f func(s *sample)) {
+	k := c.key(labelValues)
+	c.mu.Lock()
+	s, ok := c.samples[k]
+	if !ok {
+		s = &sample{values: append([]string(nil), labelValues...)}
+		c.samples[k] = s
+	}
+	f(s)
+	c.mu.Unlock()
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.writeHeader(w)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range sortedKeys(c.samples) {
+		s := c.samples[k]
+		fmt.Fprintf(w, "%s%s %s\n", c.fqName, c.labelString(s.values, "", ""), formatFloat(s.v))
+	}
+}
+
+// Gauge is a value that can go up and down per label set.
+type Gauge struct {
+	desc
+	mu      sync.Mutex
+	samples map[string]*sample
+}
+
+// NewGauge creates a gauge and registers it on DefaultRegistry.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return DefaultRegistry.NewGauge(name, help, labels...)
+}
+
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{
+		desc:    desc{fqName: name, help: help, typ: "gauge", labels: labels},
+		samples: make(map[string]*sample),
+	}
+	r.register(g)
+	return g
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.update(labelValues, func(s *sample) { s.v = v })
+}
+
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.update(labelValues, func(s *sample) { s.v += v })
+}
+
+func (g *Gauge) update(labelValues []string, f func(s *sample)) {
+	k := g.key(labelValues)
+	g.mu.Lock()
+	s, ok := g.samples[k]
+	if !ok {
+		s = &sample{values: append([]string(nil), labelValues...)}
+		g.samples[k] = s
+	}
+	f(s)
+	g.mu.Unlock()
+}
+
+// Reset drops all label sets, collectors call it before setting the current values
+// so that removed pools or shards disappear.
+func (g *Gauge) Reset() {
+	g.mu.Lock()
+	g.samples = make(map[string]*sample)
+	g.mu.Unlock()
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.writeHeader(w)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, k := range sortedKeys(g.samples) {
+		s := g.samples[k]
+		fmt.Fprintf(w, "%s%s %s\n", g.fqName, g.labelString(s.values, "", ""), formatFloat(s.v))
+	}
+}
+
+// Histogram counts observations in cumulative buckets per label set.
+type Histogram struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	samples map[string]*histogramSample
+}
+
+type histogramSample struct {
+	values []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram creates a histogram and registers it on DefaultRegistry,
+// nil buckets means DefBuckets.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return DefaultRegistry.NewHistogram(name, help, buckets, labels...)
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &Histogram{
+		desc:    desc{fqName: name, help: help, typ: "histogram", labels: labels},
+		buckets: buckets,
+		samples: make(map[string]*histogramSample),
+	}
+	r.register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	k := h.key(labelValues)
+	h.mu.Lock()
+	s, ok := h.samples[k]
+	if !ok {
+		s = &histogramSample{values: append([]string(nil), labelValues...), counts: make([]uint64, len(h.buckets))}
+		h.samples[k] = s
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+	h.mu.Unlock()
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.writeHeader(w)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, k := range sortedKeys(h.samples) {
+		s := h.samples[k]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.fqName, h.labelString(s.values, "le", formatFloat(upper)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.fqName, h.labelString(s.values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.fqName, h.labelString(s.values, "", ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.fqName, h.labelString(s.values, "", ""), s.count)
+	}
+}
+
+func sortedKeys(m interface{}) (keys []string) {
+	switch samples := m.(type) {
+	case map[string]*sample:
+		for k := range samples {
+			keys = append(keys, k)
+		}
+	case map[string]*histogramSample:
+		for k := range samples {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"bytes"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("requests_total", "Total requests.", "code")
+	g := r.NewGauge("temperature", "Current temperature.")
+	h := r.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1}, "path")
+	r.RegisterCollector(func() { g.Set(21.5) })
+
+	c.Inc("200")
+	c.Add(2, "200")
+	c.Set(5, `a"b`)
+	c.Inc(`a"b`)
+	h.Observe(0.05, "/")
+	h.Observe(0.5, "/")
+	h.Observe(5, "/")
+
+	var buf bytes.Buffer
+	r.WriteText(&buf)
+	want := `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{path="/",le="0.1"} 1
+latency_seconds_bucket{path="/",le="1"} 2
+latency_seconds_bucket{path="/",le="+Inf"} 3
+latency_seconds_sum{path="/"} 5.55
+latency_seconds_count{path="/"} 3
+# HELP requests_total Total requests.
+# TYPE requests_total counter
+requests_total{code="200"} 3
+requests_total{code="a\"b"} 6
+# HELP temperature Current temperature.
+# TYPE temperature gauge
+temperature 21.5
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWriteTextConcurrent(t *testing.T) {
+	r := NewRegistry()
+	g := r.NewGauge("shard_up", "Shard up.", "shard")
+	r.RegisterCollector(func() {
+		g.Reset()
+		for i := 0; i < 20; i++ {
+			g.Set(1, strconv.Itoa(i))
+			// As collectors waiting on pool locks
+			runtime.Gosched()
+		}
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 200; n++ {
+				var buf bytes.Buffer
+				r.WriteText(&buf)
+				if got := strings.Count(buf.String(), "shard_up{"); got != 20 {
+					t.Errorf("scraped %d of 20 shards", got)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestLabelCountMismatch(t *testing.T) {
+	defer func() {
+		if err := recover(); err == nil || !strings.Contains(err.(string), "label values") {
+			t.Errorf("expected panic, got %v", err)
+		}
+	}()
+	NewRegistry().NewCounter("c", "c", "a").Inc()
+}
@@ -7,7 +7,14 @@ import (
 	"time"
 	"github.com/feekk/zddgo/errors"
 	"github.com/feekk/zddgo/log"
+	"github.com/feekk/zddgo/metrics"
 	"github.com/feekk/zddgo/trace"
+	"strconv"
+)
+
+var (
+	httpServerRequests = metrics.NewCounter("http_server_requests_total", "Total http requests served by route and status.", "method", "route", "status")
+	httpServerDuration = metrics.NewHistogram("http_server_request_duration_seconds", "Http request latency by route.", nil, "method", "route")
 )
 
 func Route() gin.HandlerFunc {
@@ -49,6 +56,14 @@ func Route() gin.HandlerFunc {
 		respLog["resp_message"] = blw.body.String()
 		respLog["cost_time_us"] = time.Now().Sub(start).Microseconds()
 		log.Info(ctx, log.TAG_COM_REQUEST_OUT, respLog)
+
+		//unmatched paths share one route to bound the label cardinality
+		route := ctx.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpServerRequests.Inc(ctx.Request.Method, route, strconv.Itoa(ctx.Writer.Status()))
+		httpServerDuration.Observe(time.Now().Sub(start).Seconds(), ctx.Request.Method, route)
 	}
 }
 
@@ -27,7 +27,7 @@ func MysqlInit(c *DatabaseConf) (err error){
 		if err != nil{
 			return 
 		}
-		mysqlPool.conn.Store(conConf.Name, *conn)
+		mysqlPool.conn.Store(conConf.Name, conn)
 	} 
 	return
 }
@@ -46,8 +46,19 @@ func MysqlDef() *gorm.DB{
 //
 func MysqlConn(key string) (*gorm.DB, bool){
 	if pool, ok := mysqlPool.conn.Load(key); ok {
-		 p := pool.(gorm.DB)
-		return &p, true
+		return pool.(*gorm.DB), true
 	}
 	return nil, false
+}
+//
+// rangeMysql calls f with every connection, the default one is named "default".
+//
+func rangeMysql(f func(name string, db *gorm.DB)){
+	if mysqlPool.def != nil {
+		f("default", mysqlPool.def)
+	}
+	mysqlPool.conn.Range(func(key, pool interface{}) bool{
+		f(key.(string), pool.(*gorm.DB))
+		return true
+	})
 }
\ No newline at end of file
@@ -0,0 +1,75 @@
+package pool
+
+import (
+	"crypto/md5"
+	"sort"
+	"strconv"
+)
+
+// Number of md5 digests per server of weight 1, each digest gives 4 points.
+// The same as ketama, so keys map to the same servers as other ketama clients.
+const ketamaDigests = 40
+
+// hashRing is a ketama style consistent hash ring over the pool shards.
+type hashRing struct {
+	points []uint32
+	// Shard index owning each point
+	owners []int
+	// Number of distinct shards
+	size int
+}
+
+// newHashRing builds the ring, weights are aligned with servers and
+// default to 1 if missing or not positive.
+func newHashRing(servers []string, weights []int) *hashRing {
+	r := &hashRing{size: len(servers)}
+	for i, server := range servers {
+		weight := 1
+		if i < len(weights) && weights[i] > 0 {
+			weight = weights[i]
+		}
+		for j := 0; j < ketamaDigests*weight; j++ {
+			digest := md5.Sum([]byte(server + "-" + strconv.Itoa(j)))
+			for h := 0; h < 4; h++ {
+				r.points = append(r.points, ketamaPoint(digest[h*4:]))
+				r.owners = append(r.owners, i)
+			}
+		}
+	}
+	sort.Sort(r)
+	return r
+}
+
+func ketamaPoint(b []byte) uint32 {
+	return uint32(b[3])<<24 | uint32(b[2])<<16 | uint32(b[1])<<8 | uint32(b[0])
+}
+
+func (r *hashRing) Len() int           { return len(r.points) }
+func (r *hashRing) Less(i, j int) bool { return r.points[i] < r.points[j] }
+func (r *hashRing) Swap(i, j int) {
+	r.points[i], r.points[j] = r.points[j], r.points[i]
+	r.owners[i], r.owners[j] = r.owners[j], r.owners[i]
+}
+
+// walk calls f with the distinct shards clockwise from the point of key,
+// until f returns false or all shards are visited.
+func (r *hashRing) walk(key string, f func(idx int) bool) {
+	if len(r.points) == 0 {
+		return
+	}
+	digest := md5.Sum([]byte(key))
+	h := ketamaPoint(digest[:])
+	pos := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+
+	visited := make(map[int]bool, r.size)
+	for i := 0; i < len(r.points) && len(visited) < r.size; i++ {
+		idx := r.owners[(pos+i)%len(r.points)]
+		if visited[idx] {
+			continue
+		}
+		visited[idx] = true
+		if !f(idx) {
+			return
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package pool
+
+import (
+	"context"
+	"strconv"
+	"testing"
+)
+
+func ringOwner(r *hashRing, key string) (owner int) {
+	r.walk(key, func(idx int) bool {
+		owner = idx
+		return false
+	})
+	return
+}
+
+func TestHashRing(t *testing.T) {
+	servers := []string{"10.0.0.1:6379", "10.0.0.2:6379", "10.0.0.3:6379"}
+	r := newHashRing(servers, []int{1, 1, 2})
+
+	counts := make([]int, len(servers))
+	for i := 0; i < 10000; i++ {
+		counts[ringOwner(r, "key"+strconv.Itoa(i))]++
+	}
+	// The double weighted server takes about half of the keys
+	if counts[2] < 4000 || counts[2] > 6000 || counts[0] < 1500 || counts[1] < 1500 {
+		t.Errorf("unbalanced distribution %v", counts)
+	}
+
+	// Keys of remaining servers do not move when a server is gone
+	r2 := newHashRing(servers[:2], []int{1, 1})
+	for i := 0; i < 1000; i++ {
+		key := "key" + strconv.Itoa(i)
+		if owner := ringOwner(r, key); owner != 2 && ringOwner(r2, key) != owner {
+			t.Fatalf("key %s moved from %d", key, owner)
+		}
+	}
+
+	var visited []int
+	r.walk("key", func(idx int) bool {
+		visited = append(visited, idx)
+		return true
+	})
+	if len(visited) != len(servers) {
+		t.Errorf("walk visited %v", visited)
+	}
+}
+
+func TestPoolGetForKeyFailover(t *testing.T) {
+	dp := NewPool([]string{"a", "b", "c"}, &testFactory{}, DefaultPoolConfig)
+	defer dp.Shutdown()
+
+	owner := ringOwner(dp.set().ring, "user:1")
+	c, err := dp.GetForKey(context.Background(), "user:1")
+	if err != nil || c.getDataSource() != dp.set().poolShards[owner] {
+		t.Fatalf("wrong shard, err=%v", err)
+	}
+	dp.Put(c, false)
+
+	dp.set().poolShards[owner].markAvailable(false)
+	c, err = dp.GetForKey(context.Background(), "user:1")
+	if err != nil || c.getDataSource() == dp.set().poolShards[owner] {
+		t.Fatalf("no failover, err=%v", err)
+	}
+	dp.Put(c, false)
+}
@@ -0,0 +1,1132 @@
+// Package pool is a sharded connection pool with health checks, shared by
+// clients of any TCP backend, e.g. redis, memcached or thrift.
+//
+// A client implements PooledConnFactory, and its connection type embeds
+// *PooledObject to implement Poolable:
+//
+//	type conn struct {
+//		*pool.PooledObject
+//		nc net.Conn
+//	}
+//
+//	func (f factory) Create(addr string) (pool.Poolable, error) {
+//		nc, err := net.Dial("tcp", addr)
+//		if err != nil {
+//			return nil, err
+//		}
+//		return &conn{PooledObject: &pool.PooledObject{}, nc: nc}, nil
+//	}
+//
+// Connections borrowed by Get, GetContext or GetForKey must be returned by Put.
+package pool
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// If an attempt is made to return an object to the pool that is in any state
+// other than allocated (i.e. borrowed).
+// Attempting to return an object more than once or attempting to return an
+// object that was never borrowed from the pool will trigger this error.
+var ErrReturnInvalid error = errors.New("pool: object has already been returned to this pool or is invalid")
+
+// ErrNoAvailableShard is returned by GetForKey and ShardForKey when all shards are marked unavailable.
+var ErrNoAvailableShard error = errors.New("pool: no available shard")
+
+var (
+	ErrServerExists   error = errors.New("pool: server already exists")
+	ErrServerNotFound error = errors.New("pool: server not found")
+	ErrNoServers      error = errors.New("pool: at least one server is required")
+)
+
+type Pool struct {
+	// @atomic *shardSet, replaced as a whole when servers change
+	shards atomic.Value
+	// Function to create a new pooled client for server @serverAddr
+	connFactory PooledConnFactory
+	// Pool configuration, e.t. maxIdle, maxActive, ...
+	poolConfig PoolConfig
+	// @atomic index to pick the next shard
+	index uint32
+	// Suspect shards, should be checked immediately
+	suspectShards chan *PoolShard
+	// Guards changes of shards and numAvailable
+	mu sync.Mutex
+	// Current available servers
+	numAvailable int
+	// Stopper signal to stop checker coroutine
+	stopper chan struct{}
+	// WaitGroup to wait health checker goroutine to stop
+	wg sync.WaitGroup
+}
+
+// shardSet is the shard list of a Pool. It is never modified, so that
+// indexes picked from it stay valid while servers are added or removed.
+type shardSet struct {
+	// Server address list, e.t. []string{"127.0.0.1:8080", "127.0.0.1:8081"}
+	serverList []string
+	// Sharded pool by server address
+	poolShards []*PoolShard
+	// Weights aligned with serverList
+	weights []int
+	// Consistent hash ring to pick the shard of a key
+	ring     *hashRing
+	maxRetry int
+}
+
+func newShardSet(servers []string, shards []*PoolShard, weights []int) *shardSet {
+	s := &shardSet{
+		serverList: servers,
+		poolShards: shards,
+		weights:    make([]int, len(servers)),
+		maxRetry:   len(servers),
+	}
+	copy(s.weights, weights)
+	s.ring = newHashRing(servers, s.weights)
+	if s.maxRetry < 5 {
+		s.maxRetry = 5
+	}
+	return s
+}
+
+func NewPool(servers []string, connFactory PooledConnFactory, poolConfig PoolConfig) *Pool {
+	if servers == nil || len(servers) == 0 || connFactory == nil {
+		panic("Illegal Arguments")
+	}
+
+	numServers := len(servers)
+	if poolConfig.CheckInterval <= 0 {
+		poolConfig.CheckInterval = 3 * time.Second
+	}
+	if poolConfig.CheckTries <= 0 {
+		poolConfig.CheckTries = 2
+	}
+	if poolConfig.MaxUnavailable <= 0 {
+		poolConfig.MaxUnavailable = 1.0 / 3
+	}
+
+	dp := &Pool{
+		connFactory:   connFactory,
+		poolConfig:    poolConfig,
+		suspectShards: make(chan *PoolShard, 100),
+		numAvailable:  numServers,
+		stopper:       make(chan struct{}),
+	}
+	poolShards := make([]*PoolShard, numServers)
+	for i := 0; i < numServers; i++ {
+		shard := NewPoolShard(servers[i], dp, poolConfig)
+		poolShards[i] = shard
+	}
+	dp.shards.Store(newShardSet(servers, poolShards, poolConfig.Weights))
+
+	dp.wg.Add(1)
+	go dp.goCheckServer()
+	if poolConfig.IdleTimeout > 0 {
+		dp.wg.Add(1)
+		go dp.goEvictIdle()
+	}
+
+	return dp
+}
+
+func (dp *Pool) Get() (Poolable, error) {
+	return dp.GetContext(context.Background())
+}
+
+// GetContext is like Get, ctx bounds the time waiting for an exhausted shard.
+func (dp *Pool) GetContext(ctx context.Context) (Poolable, error) {
+	var localIdx uint32 = atomic.AddUint32(&dp.index, 1)
+	s := dp.set()
+
+	for tries := 0; tries < s.maxRetry; tries++ {
+		idx := (localIdx + uint32(tries)) % uint32(len(s.poolShards))
+
+		// The server shard selected may be down, continue to get the next one
+		if !s.poolShards[idx].isAvailable() {
+			atomic.AddUint32(&dp.index, 1)
+			continue
+		}
+
+		shard := s.poolShards[idx]
+		c, err := shard.get(ctx)
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return nil, err
+		}
+		// Waiting on the next shards would only add up the wait timeouts,
+		// without Wait they are tried at once
+		if shard.wait && (err == ErrPoolExhausted || err == ErrPoolClosed) {
+			return nil, err
+		}
+		if err != nil {
+			atomic.AddUint32(&dp.index, 1)
+			continue
+		}
+		return c, nil
+	}
+
+	return nil, fmt.Errorf("pool: failed to get connection after %d retries", s.maxRetry)
+}
+
+// set returns the current shard list.
+func (dp *Pool) set() *shardSet {
+	return dp.shards.Load().(*shardSet)
+}
+
+// ConnFactory returns the factory creating the connections of the pool.
+func (dp *Pool) ConnFactory() PooledConnFactory {
+	return dp.connFactory
+}
+
+// Shards returns the current shards, aligned with Servers.
+func (dp *Pool) Shards() []*PoolShard {
+	return append([]*PoolShard(nil), dp.set().poolShards...)
+}
+
+// Servers returns the current server list.
+func (dp *Pool) Servers() []string {
+	return append([]string(nil), dp.set().serverList...)
+}
+
+// AddServer adds a shard for server, weight is its weight on the hash ring.
+func (dp *Pool) AddServer(server string, weight int) error {
+	return dp.update(func(s *shardSet) ([]string, []int, error) {
+		for _, addr := range s.serverList {
+			if addr == server {
+				return nil, nil, ErrServerExists
+			}
+		}
+		return append(append([]string(nil), s.serverList...), server), append(append([]int(nil), s.weights...), weight), nil
+	})
+}
+
+// RemoveServer removes the shard of server, which is drained: it is not
+// borrowed from anymore, idle connections are closed at once and borrowed
+// ones when returned.
+func (dp *Pool) RemoveServer(server string) error {
+	return dp.update(func(s *shardSet) (servers []string, weights []int, err error) {
+		for i, addr := range s.serverList {
+			if addr != server {
+				servers = append(servers, addr)
+				weights = append(weights, s.weights[i])
+			}
+		}
+		if len(servers) == len(s.serverList) {
+			return nil, nil, ErrServerNotFound
+		}
+		return servers, weights, nil
+	})
+}
+
+// ReplaceServers replaces the server list, e.g. on config reload. Shards of
+// kept servers are kept, the removed ones are drained as by RemoveServer.
+// weights are aligned with servers as PoolConfig.Weights.
+func (dp *Pool) ReplaceServers(servers []string, weights []int) error {
+	return dp.update(func(s *shardSet) ([]string, []int, error) {
+		return append([]string(nil), servers...), weights, nil
+	})
+}
+
+// update replaces the shard list by the servers returned by f.
+func (dp *Pool) update(f func(s *shardSet) ([]string, []int, error)) error {
+	dp.mu.Lock()
+	old := dp.set()
+	servers, weights, err := f(old)
+	if err == nil && len(servers) == 0 {
+		err = ErrNoServers
+	}
+	if err != nil {
+		dp.mu.Unlock()
+		return err
+	}
+
+	removed := make(map[string]*PoolShard, len(old.poolShards))
+	for _, shard := range old.poolShards {
+		removed[shard.server] = shard
+	}
+	var added []*PoolShard
+	shards := make([]*PoolShard, len(servers))
+	for i, server := range servers {
+		if shard, ok := removed[server]; ok {
+			shards[i] = shard
+			delete(removed, server)
+			continue
+		}
+		for _, shard := range shards[:i] {
+			if shard.server == server {
+				dp.mu.Unlock()
+				return ErrServerExists
+			}
+		}
+		shards[i] = NewPoolShard(server, dp, dp.poolConfig)
+		added = append(added, shards[i])
+	}
+
+	dp.shards.Store(newShardSet(servers, shards, weights))
+	dp.numAvailable = 0
+	for _, shard := range shards {
+		if shard.isAvailable() {
+			dp.numAvailable++
+		}
+	}
+	dp.mu.Unlock()
+
+	for _, shard := range removed {
+		shard.Close()
+	}
+	for _, shard := range added {
+		dp.notifyAvailable(shard)
+	}
+	return nil
+}
+
+// GetForKey gets a connection from the shard owning key on the consistent
+// hash ring. If that shard is marked unavailable, the next one on the ring is used.
+func (dp *Pool) GetForKey(ctx context.Context, key string) (Poolable, error) {
+	shard, err := dp.ShardForKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return shard.get(ctx)
+}
+
+// ShardForKey returns the shard GetForKey gets connections from for key.
+func (dp *Pool) ShardForKey(key string) (shard *PoolShard, err error) {
+	err = ErrNoAvailableShard
+	s := dp.set()
+	s.ring.walk(key, func(idx int) bool {
+		if !s.poolShards[idx].isAvailable() {
+			return true
+		}
+		shard, err = s.poolShards[idx], nil
+		return false
+	})
+	return
+}
+
+func (dp *Pool) Put(c Poolable, broken bool) error {
+	shard := c.getDataSource()
+	if shard == nil {
+		dp.connFactory.Close(c)
+		return ErrReturnInvalid
+	}
+	return shard.put(c, broken)
+}
+
+func (dp *Pool) markAvailable(shard *PoolShard, b bool) {
+	if !dp.setAvailable(shard, b) {
+		return
+	}
+	// Out of the lock, hooks may take a while
+	if b {
+		dp.notifyAvailable(shard)
+	}
+	dp.notifyChange(shard, b)
+}
+
+// setAvailable marks shard and returns whether it is changed.
+func (dp *Pool) setAvailable(shard *PoolShard, b bool) bool {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	// Removed meanwhile
+	if atomic.LoadUint32(&shard.closed) == 1 {
+		return false
+	}
+	if b {
+		if shard.markAvailable(true) {
+			dp.numAvailable++
+			return true
+		}
+	} else {
+		if !shard.isAvailable() {
+			return false
+		}
+		totalServers := len(dp.set().poolShards)
+		// Ensure that at most MaxUnavailable of the servers can be marked as unavaialable
+		if float64(totalServers-dp.numAvailable) < dp.poolConfig.MaxUnavailable*float64(totalServers) {
+			if shard.markAvailable(false) {
+				dp.numAvailable--
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (dp *Pool) notifyChange(shard *PoolShard, available bool) {
+	if dp.poolConfig.OnAvailabilityChange != nil {
+		dp.poolConfig.OnAvailabilityChange(shard.server, available)
+	}
+}
+
+func (dp *Pool) checkServer(server string) (ok bool) {
+	for tries := 1; tries <= dp.poolConfig.CheckTries; tries++ {
+		c, err := dp.connFactory.Create(server)
+		if err != nil {
+			continue
+		}
+
+		if err := dp.connFactory.Validate(c); err != nil {
+			dp.connFactory.Close(c)
+			continue
+		}
+
+		dp.connFactory.Close(c)
+		return true
+	}
+
+	return false
+}
+
+func (dp *Pool) notifyAvailable(shard *PoolShard) {
+	if dp.poolConfig.OnAvailable != nil {
+		dp.poolConfig.OnAvailable(shard.server)
+	}
+}
+
+func (dp *Pool) check(shard *PoolShard) {
+	ok := dp.checkServer(shard.server)
+	atomic.StoreInt64(&shard.lastCheck, time.Now().UnixNano())
+	dp.markAvailable(shard, ok)
+}
+
+// Check server availiability periodically
+func (dp *Pool) goCheckServer() {
+	defer dp.wg.Done()
+	var timer *time.Ticker = time.NewTicker(dp.poolConfig.CheckInterval)
+	defer timer.Stop()
+
+	for _, shard := range dp.set().poolShards {
+		dp.notifyAvailable(shard)
+	}
+
+	for {
+		select {
+		case <-timer.C:
+			for _, shard := range dp.set().poolShards {
+				// Healthy shards can be exampt from examination
+				if !shard.suspectable() && shard.isAvailable() {
+					continue
+				}
+				dp.check(shard)
+			}
+		case shard := <-dp.suspectShards:
+			dp.check(shard)
+		case <-dp.stopper:
+			return
+		}
+	}
+}
+
+// Evict idle connections periodically, so that connections closed by the
+// server are not handed out.
+func (dp *Pool) goEvictIdle() {
+	defer dp.wg.Done()
+	interval := dp.poolConfig.IdleTimeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	var timer *time.Ticker = time.NewTicker(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			for _, shard := range dp.set().poolShards {
+				shard.evictIdle()
+			}
+		case <-dp.stopper:
+			return
+		}
+	}
+}
+
+func (dp *Pool) Shutdown() {
+	close(dp.stopper)
+	dp.wg.Wait()
+	for _, shard := range dp.set().poolShards {
+		shard.Close()
+	}
+}
+
+type PoolStats struct {
+	Shard        string `json:"shard"`
+	Available    bool   `json:"available"`
+	NumActive    int    `json:"num_active"`
+	NumGet       uint64 `json:"num_get"`
+	NumPut       uint64 `json:"num_put"`
+	NumBroken    uint64 `json:"num_broken"`
+	NumDial      uint64 `json:"num_dial"`
+	NumDialError uint64 `json:"num_dial_error"`
+	NumEvict     uint64 `json:"num_evict"`
+	NumClose     uint64 `json:"num_close"`
+	// Borrows which had to wait for an exhausted shard
+	NumWait        uint64        `json:"num_wait"`
+	NumWaitTimeout uint64        `json:"num_wait_timeout"`
+	WaitDuration   time.Duration `json:"wait_duration"`
+	// Idle connections validated on borrow and the failed ones
+	NumTest       uint64 `json:"num_test"`
+	NumTestFailed uint64 `json:"num_test_failed"`
+	// Idle connections and borrows waiting at the time of the call
+	NumIdle    int `json:"num_idle"`
+	NumWaiting int `json:"num_waiting"`
+	// Failures in succession, the shard is checked when it reaches MaxFails
+	FailStreak int `json:"fail_streak"`
+	// Time of the last health check, zero if never checked. Healthy shards
+	// are only checked when suspected
+	LastCheck time.Time `json:"last_check"`
+}
+
+// GetPoolStats returns the stats of every shard, counters are cumulative
+// since the pool is created. See StatsWindow for rates.
+func (dp *Pool) GetPoolStats() (stats []PoolStats) {
+	s := dp.set()
+	stats = make([]PoolStats, len(s.poolShards))
+	for i, shard := range s.poolShards {
+		stats[i] = shard.getStats()
+	}
+	return
+}
+
+
+type PoolConfig struct {
+	// Maximum idle connections per shard
+	MaxIdle int
+	// The maximum number of active connections that can be allocated from per pool shard at the same time.
+	// The default value is 100
+	MaxActive int
+	// Timeout to evict idle connections
+	IdleTimeout time.Duration
+	// Test if connection broken on borrow
+	// If set this flag, the "test" function should also provided.
+	TestOnBorrow bool
+	// Only test connections idle longer than this, zero means test on every borrow
+	TestIdleThreshold time.Duration
+	// Number of max fails threshold to triger health check
+	MaxFails int
+	// Wait for a connection to be returned when a shard reaches MaxActive,
+	// instead of failing with ErrPoolExhausted at once. Waiters are served in FIFO order.
+	Wait bool
+	// Maximum time to wait, zero means wait until the context is done
+	WaitTimeout time.Duration
+	// Weights of servers on the consistent hash ring used by GetForKey,
+	// aligned with the server list. Missing weights default to 1.
+	Weights []int
+	// Interval of health checks of unavailable and suspected shards, 3 seconds by default
+	CheckInterval time.Duration
+	// Connection attempts of a health check, 2 by default
+	CheckTries int
+	// Maximum fraction of the shards marked unavailable, 1/3 by default.
+	// Failing shards over it are kept, so that one issue does not stop the whole pool
+	MaxUnavailable float64
+	// Optional, called by the health checker when a shard is marked
+	// available or unavailable, e.g. to log and alert. It should not block
+	OnAvailabilityChange func(server string, available bool)
+	// Optional, called by the health checker with the server of every shard
+	// when the pool is created or the shard is added, and when a shard is
+	// marked available again, e.g. to warm up the server. It should not block
+	OnAvailable func(server string)
+}
+
+var DefaultPoolConfig PoolConfig = PoolConfig{
+	MaxIdle:     50,
+	MaxActive:   100,
+	IdleTimeout: 300 * time.Second,
+	MaxFails:    5,
+}
+
+
+
+type PooledConnFactory interface {
+	// Function to create a new pooled client for server @serverAddr
+	Create(addr string) (Poolable, error)
+
+	// testOnBorrow is an optional application supplied function for checking
+	// the health of an idle connection before the connection is used again by
+	// the application. Argument t is the time that the connection was returned
+	// to the pool. If the function returns an error, then the connection is
+	// closed.
+	Validate(c Poolable) error
+
+	// Function to destroy a connection
+	Close(c Poolable) error
+}
+
+
+// Poolable represents a connection to a server. The methods are private to
+// the pool, implement it by embedding *PooledObject.
+type Poolable interface {
+	// @private
+	lock()
+	unlock()
+
+	// @private
+	setTime(t time.Time)
+	getTime() time.Time
+
+	// @private
+	getDataSource() *PoolShard
+	setDataSource(shard *PoolShard)
+
+	// @private
+	isBorrowed() bool
+	setBorrowed(b bool)
+}
+
+// Implements Poolable interface, embedded by the connection types of clients.
+type PooledObject struct {
+	dataSource *PoolShard
+	t          time.Time
+	borrowed   bool
+	state      int
+	mu         sync.Mutex
+}
+
+// @private
+func (pc *PooledObject) lock() {
+	pc.mu.Lock()
+}
+
+// @private
+func (pc *PooledObject) unlock() {
+	pc.mu.Unlock()
+}
+
+// @private
+func (pc *PooledObject) setDataSource(shard *PoolShard) {
+	pc.dataSource = shard
+}
+
+// @private
+func (pc *PooledObject) getDataSource() (shard *PoolShard) {
+	return pc.dataSource
+}
+
+// @private
+func (pc *PooledObject) setTime(t time.Time) {
+	pc.t = t
+}
+
+// @private
+func (pc *PooledObject) getTime() (t time.Time) {
+	t = pc.t
+	return t
+}
+
+// @private
+func (pc *PooledObject) isBorrowed() bool {
+	return pc.borrowed
+}
+
+// @private
+func (pc *PooledObject) setBorrowed(b bool) {
+	pc.borrowed = b
+}
+
+
+
+
+
+
+
+
+var (
+	// errPoolExhausted is returned from a pool connection method when
+	// the maximum number of connections in the pool has been reached.
+	ErrPoolExhausted = errors.New("dpool: connection pool exhausted")
+
+	ErrPoolClosed = errors.New("dpool: connection pool closed")
+	ErrConnClosed = errors.New("dpool: connection closed")
+)
+
+type PoolShard struct {
+	// Maximum number of idle connections in the pool.
+	// @const
+	maxIdle int
+
+	// Maximum number of connections allocated by the pool at a given time.
+	// When zero, there is no limit on the number of connections in the pool.
+	// @const
+	maxActive int32
+
+	// Current number of active connections
+	// @atomic
+	active int32
+
+	// Close connections after remaining idle for this duration. If the value
+	// is zero, then idle connections are not closed. Applications should set
+	// the timeout to a value less than the server's timeout.
+	idleTimeout time.Duration
+
+	// Validate idle connections idle longer than testIdleThreshold on borrow.
+	// @const
+	testOnBorrow      bool
+	testIdleThreshold time.Duration
+
+	// If wait is true and the pool is at the maxActive limit, then Get() waits
+	// for a connection to be returned to the pool before returning.
+	// @const
+	wait        bool
+	waitTimeout time.Duration
+
+	// Queue of *waiter, guarded by mu. Returning a connection or releasing
+	// an active slot also takes mu, so that no waiter misses a wakeup.
+	mu      sync.Mutex
+	waiters list.List
+
+	// @atomic
+	closed uint32
+
+	// Stack of idle Poolable with most recently used at the front.
+	idle chan Poolable
+
+	// Server address, e.g. "127.0.0.1:8080"
+	// @const
+	server string
+
+	dpool *Pool
+
+	// If marked as unavailable, then the checking goroutine will check it availability periodically.
+	// A server is "available" if we can connnect to it, and respond to Ping() request of client.
+	// Since no atomic boolean provided in Golang, we use uint32 instead.
+	// @atomic
+	available uint32
+
+	// The failure count in succession. If the fails reached the threshold of "unavailable",
+	// then this server should be marked as "unavailable", and we will not get connection
+	// from it until recovered.
+	// The idea of "fails" & "maxFails" is borrowed from Nginx.
+	// @atomic
+	fails uint32
+
+	// The idea of "fails" & "maxFails" is borrowed from Nginx.
+	// @const
+	maxFails uint32
+
+	// Unix nano of the last health check
+	// @atomic
+	lastCheck int64
+
+	stats PoolStats
+}
+
+// NewPoolShard creates a new pool shard.
+func NewPoolShard(server string, parent *Pool, poolConfig PoolConfig) *PoolShard {
+	return &PoolShard{
+		server:            server,
+		dpool:             parent,
+		maxIdle:           poolConfig.MaxIdle,
+		maxActive:         int32(poolConfig.MaxActive),
+		idleTimeout:       poolConfig.IdleTimeout,
+		testOnBorrow:      poolConfig.TestOnBorrow,
+		testIdleThreshold: poolConfig.TestIdleThreshold,
+		idle:              make(chan Poolable, poolConfig.MaxIdle),
+		wait:              poolConfig.Wait,
+		waitTimeout:       poolConfig.WaitTimeout,
+		available:         1,
+		closed:            0,
+		maxFails:          uint32(poolConfig.MaxFails),
+	}
+}
+
+// waiter is a borrower blocked on an exhausted shard. It receives either an
+// idle connection, or nil which means an active slot is reserved for it to dial.
+type waiter struct {
+	ch chan Poolable
+}
+
+// If state changed, return true
+func (p *PoolShard) markAvailable(b bool) (changed bool) {
+	if b {
+		return atomic.CompareAndSwapUint32(&p.available, 0, 1)
+	}
+	p.empty()
+	return atomic.CompareAndSwapUint32(&p.available, 1, 0)
+}
+
+// Server returns the server address of the shard.
+func (p *PoolShard) Server() string {
+	return p.server
+}
+
+// Available reports whether the shard is not marked unavailable by the health checker.
+func (p *PoolShard) Available() bool {
+	return p.isAvailable()
+}
+
+// Get borrows a connection from this shard only, e.g. to send a command to
+// every shard. It must be returned by Pool.Put.
+func (p *PoolShard) Get(ctx context.Context) (Poolable, error) {
+	return p.get(ctx)
+}
+
+func (p *PoolShard) isAvailable() bool {
+	if atomic.LoadUint32(&p.available) != 0 {
+		return true
+	}
+	return false
+}
+
+// markFailed mark this shard as "suspect" or not
+func (p *PoolShard) markFailed(failed bool) {
+	if failed {
+		s := atomic.AddUint32(&p.fails, 1)
+		if s == p.maxFails {
+			select {
+			case p.dpool.suspectShards <- p:
+			default: /*do nothing*/
+			}
+		}
+	} else {
+		atomic.StoreUint32(&p.fails, 0)
+	}
+}
+
+func (p *PoolShard) suspectable() bool {
+	if atomic.LoadUint32(&p.fails) >= p.maxFails {
+		return true
+	}
+	return false
+}
+
+// Close releases the resources used by the pool shard.
+func (p *PoolShard) Close() error {
+	if !atomic.CompareAndSwapUint32(&p.closed, 0, 1) {
+		return errors.New("dpool: close pool shard already closed")
+	}
+	p.empty()
+	p.mu.Lock()
+	for e := p.waiters.Front(); e != nil; e = e.Next() {
+		close(e.Value.(*waiter).ch)
+	}
+	p.waiters.Init()
+	p.mu.Unlock()
+	return nil
+}
+
+// get prunes stale connections and returns a connection from the idle channel or
+// creates a new connection.
+// The application must return the borrowed connection.
+func (p *PoolShard) get(ctx context.Context) (c Poolable, err error) {
+	// Check for pool closed before creating a new connection.
+	if atomic.LoadUint32(&p.closed) == 1 {
+		return nil, errors.New("dpool: get on closed pool shard")
+	}
+
+	atomic.AddUint64(&p.stats.NumGet, 1)
+
+	if c = p.getIdle(); c != nil {
+		c.setBorrowed(true)
+		return c, nil
+	}
+
+	if !p.acquire() {
+		if !p.wait {
+			return nil, ErrPoolExhausted
+		}
+		if c, err = p.waitIdle(ctx); err != nil {
+			return nil, err
+		}
+		if c != nil {
+			c.setBorrowed(true)
+			return c, nil
+		}
+		// An active slot has been reserved for us, dial below
+	}
+
+	atomic.AddUint64(&p.stats.NumDial, 1)
+	if c, err = p.dpool.connFactory.Create(p.server); err != nil {
+		p.markFailed(true)
+		atomic.AddUint64(&p.stats.NumDialError, 1)
+		p.release()
+		return nil, err
+	}
+
+	// Setup pooled connection
+	p.markFailed(false)
+	c.setDataSource(p)
+	c.setBorrowed(true)
+	return c, nil
+}
+
+// acquire takes an active slot if under maxActive.
+func (p *PoolShard) acquire() bool {
+	for {
+		active := atomic.LoadInt32(&p.active)
+		if p.maxActive != 0 && active >= p.maxActive {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&p.active, active, active+1) {
+			return true
+		}
+	}
+}
+
+// release gives back an active slot of a closed connection, and hands it
+// over to the first waiter if any.
+func (p *PoolShard) release() {
+	if !p.wait {
+		atomic.AddInt32(&p.active, -1)
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Hand the slot over without freeing it, so that no concurrent get
+	// takes it ahead of the waiters
+	if p.waiters.Len() > 0 {
+		w := p.waiters.Remove(p.waiters.Front()).(*waiter)
+		w.ch <- nil
+		return
+	}
+	atomic.AddInt32(&p.active, -1)
+}
+
+// waitIdle blocks until a connection is returned or an active slot is freed.
+// A nil connection with nil error means a slot is reserved for the caller.
+func (p *PoolShard) waitIdle(ctx context.Context) (c Poolable, err error) {
+	var e *list.Element
+	w := &waiter{ch: make(chan Poolable, 1)}
+	for e == nil {
+		p.mu.Lock()
+		// Check again under lock, put or release may have happened meanwhile
+		select {
+		case c = <-p.idle:
+		default:
+		}
+		if c != nil {
+			p.mu.Unlock()
+			if !p.checkIdle(c) {
+				c = nil
+				continue
+			}
+			return c, nil
+		}
+		if p.acquire() {
+			p.mu.Unlock()
+			return nil, nil
+		}
+		e = p.waiters.PushBack(w)
+		p.mu.Unlock()
+	}
+
+	atomic.AddUint64(&p.stats.NumWait, 1)
+	start := time.Now()
+	defer func() {
+		atomic.AddInt64((*int64)(&p.stats.WaitDuration), int64(time.Since(start)))
+	}()
+
+	var timeout <-chan time.Time
+	if p.waitTimeout > 0 {
+		timer := time.NewTimer(p.waitTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case c, ok := <-w.ch:
+		if !ok {
+			return nil, ErrPoolClosed
+		}
+		return c, nil
+	case <-timeout:
+		err = ErrPoolExhausted
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	p.mu.Lock()
+	select {
+	case c, ok := <-w.ch:
+		// Handed over right before giving up, take it anyway
+		p.mu.Unlock()
+		if !ok {
+			return nil, ErrPoolClosed
+		}
+		return c, nil
+	default:
+		p.waiters.Remove(e)
+	}
+	p.mu.Unlock()
+	if err == ErrPoolExhausted {
+		atomic.AddUint64(&p.stats.NumWaitTimeout, 1)
+	}
+	return nil, err
+}
+
+// getIdle returns an idle connection which is not stale, or nil if there is none.
+func (p *PoolShard) getIdle() Poolable {
+	for {
+		select {
+		case c := <-p.idle:
+			if !p.checkIdle(c) {
+				continue
+			}
+			return c
+		default:
+			return nil
+		}
+	}
+}
+
+func (p *PoolShard) put(c Poolable, broken bool) error {
+	// XXX: Check if this object is borrowed and mark returning MUST be atomic
+	c.lock()
+	if !c.isBorrowed() {
+		c.unlock()
+		return ErrReturnInvalid
+	}
+	c.setBorrowed(false)
+	c.unlock()
+
+	p.markFailed(broken)
+	atomic.AddUint64(&p.stats.NumPut, 1)
+	if broken {
+		atomic.AddUint64(&p.stats.NumBroken, 1)
+	}
+
+	if broken || atomic.LoadUint32(&p.closed) == 1 {
+		atomic.AddUint64(&p.stats.NumClose, 1)
+		err := p.dpool.connFactory.Close(c)
+		p.release()
+		return err
+	}
+
+	c.setTime(time.Now())
+	if !p.putIdle(c) {
+		atomic.AddUint64(&p.stats.NumEvict, 1)
+		atomic.AddUint64(&p.stats.NumClose, 1)
+		err := p.dpool.connFactory.Close(c)
+		p.release()
+		return err
+	}
+
+	return nil
+}
+
+// putIdle hands c over to the first waiter if any, or pushes it to the idle
+// channel. It returns false if the idle channel is full.
+func (p *PoolShard) putIdle(c Poolable) bool {
+	if p.wait {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.waiters.Len() > 0 {
+			w := p.waiters.Remove(p.waiters.Front()).(*waiter)
+			w.ch <- c
+			return true
+		}
+	}
+	select {
+	case p.idle <- c:
+		return true
+	default:
+		return false
+	}
+}
+
+// isStale reports whether c has been idle longer than idleTimeout.
+func (p *PoolShard) isStale(c Poolable) bool {
+	return p.idleTimeout > 0 && time.Since(c.getTime()) > p.idleTimeout
+}
+
+// checkIdle evicts c if stale and tests it if testOnBorrow is set, a failed
+// connection is closed and false returned.
+func (p *PoolShard) checkIdle(c Poolable) bool {
+	if p.isStale(c) {
+		p.evict(c)
+		return false
+	}
+	if !p.testOnBorrow || (p.testIdleThreshold > 0 && time.Since(c.getTime()) <= p.testIdleThreshold) {
+		return true
+	}
+	atomic.AddUint64(&p.stats.NumTest, 1)
+	if err := p.dpool.connFactory.Validate(c); err != nil {
+		atomic.AddUint64(&p.stats.NumTestFailed, 1)
+		atomic.AddUint64(&p.stats.NumClose, 1)
+		p.dpool.connFactory.Close(c)
+		p.release()
+		return false
+	}
+	return true
+}
+
+// evict closes an idle connection taken out of the idle channel.
+func (p *PoolShard) evict(c Poolable) {
+	p.dpool.connFactory.Close(c)
+	p.release()
+	atomic.AddUint64(&p.stats.NumEvict, 1)
+	atomic.AddUint64(&p.stats.NumClose, 1)
+}
+
+// evictIdle closes the stale idle connections and puts the others back.
+func (p *PoolShard) evictIdle() {
+	for n := len(p.idle); n > 0; n-- {
+		select {
+		case c := <-p.idle:
+			if p.isStale(c) {
+				p.evict(c)
+				continue
+			}
+			if !p.putIdle(c) {
+				p.evict(c)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Empty removes and calls Close() on all the connections currently in the pool.
+// Assuming there are no other connections waiting to be Put back this method
+// effectively closes and cleans up the pool.
+func (p *PoolShard) empty() {
+	for {
+		select {
+		case c := <-p.idle:
+			p.dpool.connFactory.Close(c)
+			p.release()
+			atomic.AddUint64(&p.stats.NumClose, 1)
+		default:
+			return
+		}
+	}
+}
+
+// Get statistics for this pool shard
+func (p *PoolShard) getStats() (stats PoolStats) {
+	stats.Shard = p.server
+	stats.NumActive = int(atomic.LoadInt32(&p.active))
+	if atomic.LoadUint32(&p.available) == 1 {
+		stats.Available = true
+	} else {
+		stats.Available = false
+	}
+
+	// Counters are not reset, so that several readers do not interfere
+	stats.NumGet = atomic.LoadUint64(&p.stats.NumGet)
+	stats.NumPut = atomic.LoadUint64(&p.stats.NumPut)
+	stats.NumBroken = atomic.LoadUint64(&p.stats.NumBroken)
+	stats.NumClose = atomic.LoadUint64(&p.stats.NumClose)
+	stats.NumDial = atomic.LoadUint64(&p.stats.NumDial)
+	stats.NumDialError = atomic.LoadUint64(&p.stats.NumDialError)
+	stats.NumEvict = atomic.LoadUint64(&p.stats.NumEvict)
+	stats.NumWait = atomic.LoadUint64(&p.stats.NumWait)
+	stats.NumWaitTimeout = atomic.LoadUint64(&p.stats.NumWaitTimeout)
+	stats.WaitDuration = time.Duration(atomic.LoadInt64((*int64)(&p.stats.WaitDuration)))
+	stats.NumTest = atomic.LoadUint64(&p.stats.NumTest)
+	stats.NumTestFailed = atomic.LoadUint64(&p.stats.NumTestFailed)
+
+	stats.NumIdle = len(p.idle)
+	p.mu.Lock()
+	stats.NumWaiting = p.waiters.Len()
+	p.mu.Unlock()
+	stats.FailStreak = int(atomic.LoadUint32(&p.fails))
+	if t := atomic.LoadInt64(&p.lastCheck); t != 0 {
+		stats.LastCheck = time.Unix(0, t)
+	}
+	return
+}
@@ -0,0 +1,350 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testConn struct {
+	*PooledObject
+	closed bool
+}
+
+// testFactory creates in-memory connections, dialing fails while down is set.
+type testFactory struct {
+	down    uint32
+	created uint32
+	invalid uint32
+}
+
+func (f *testFactory) Create(addr string) (Poolable, error) {
+	if atomic.LoadUint32(&f.down) == 1 {
+		return nil, errors.New("test: server down")
+	}
+	atomic.AddUint32(&f.created, 1)
+	return &testConn{PooledObject: &PooledObject{}}, nil
+}
+
+func (f *testFactory) Validate(c Poolable) error {
+	if atomic.LoadUint32(&f.invalid) == 1 {
+		return errors.New("test: invalid")
+	}
+	return nil
+}
+
+func (f *testFactory) Close(c Poolable) error {
+	if tc, ok := c.(*testConn); ok {
+		tc.closed = true
+	}
+	return nil
+}
+
+func TestPoolShardEvictIdle(t *testing.T) {
+	f := &testFactory{}
+	conf := DefaultPoolConfig
+	conf.IdleTimeout = 50 * time.Millisecond
+	dp := NewPool([]string{"a"}, f, conf)
+	defer dp.Shutdown()
+	shard := dp.set().poolShards[0]
+
+	c, err := dp.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dp.Put(c, false)
+	if c2, _ := dp.Get(); c2 != c {
+		t.Fatal("fresh idle connection not reused")
+	}
+	dp.Put(c, false)
+
+	time.Sleep(60 * time.Millisecond)
+	c2, err := dp.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c2 == c || !c.(*testConn).closed {
+		t.Error("stale idle connection not evicted on borrow")
+	}
+	dp.Put(c2, false)
+
+	c2.setTime(time.Now().Add(-time.Minute))
+	shard.evictIdle()
+	stats := shard.getStats()
+	if !c2.(*testConn).closed || stats.NumEvict != 2 || stats.NumActive != 0 {
+		t.Errorf("reaper did not evict: %+v", stats)
+	}
+}
+
+func TestPoolShardWait(t *testing.T) {
+	f := &testFactory{}
+	conf := DefaultPoolConfig
+	conf.MaxActive = 1
+	conf.Wait = true
+	conf.WaitTimeout = 30 * time.Millisecond
+	dp := NewPool([]string{"a"}, f, conf)
+	defer dp.Shutdown()
+	shard := dp.set().poolShards[0]
+
+	c, err := dp.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = shard.get(context.Background()); err != ErrPoolExhausted {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+
+	// Waiters are served in FIFO order
+	got := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func(i int) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			c, err := dp.set().poolShards[0].get(ctx)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			got <- i
+			time.Sleep(5 * time.Millisecond)
+			dp.Put(c, false)
+		}(i)
+		time.Sleep(10 * time.Millisecond)
+	}
+	dp.Put(c, false)
+	if a, b := <-got, <-got; a != 0 || b != 1 {
+		t.Errorf("waiters served out of order: %d %d", a, b)
+	}
+
+	c, _ = dp.Get()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		cancel()
+	}()
+	if _, err = shard.get(ctx); err != context.Canceled {
+		t.Errorf("expected canceled, got %v", err)
+	}
+
+	// A broken connection frees the slot for the waiter to dial
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		dp.Put(c, true)
+	}()
+	if c, err = shard.get(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	stats := shard.getStats()
+	if stats.NumWait != 6 || stats.NumWaitTimeout != 1 || stats.NumActive != 1 || stats.WaitDuration == 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestPoolGetExhausted(t *testing.T) {
+	conf := DefaultPoolConfig
+	conf.MaxActive = 1
+	conf.Wait = true
+	conf.WaitTimeout = 50 * time.Millisecond
+	dp := NewPool([]string{"a"}, &testFactory{}, conf)
+	defer dp.Shutdown()
+
+	c, err := dp.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	// Not retried on the same shard
+	if _, err = dp.Get(); err != ErrPoolExhausted {
+		t.Errorf("expected exhausted, got %v", err)
+	}
+	if d := time.Since(start); d > 150*time.Millisecond {
+		t.Errorf("waited %v", d)
+	}
+	if stats := dp.GetPoolStats()[0]; stats.NumWaitTimeout != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	dp.Put(c, false)
+}
+
+func TestPoolGetNextShard(t *testing.T) {
+	conf := DefaultPoolConfig
+	conf.MaxActive = 1
+	dp := NewPool([]string{"a", "b"}, &testFactory{}, conf)
+	defer dp.Shutdown()
+
+	c1, err := dp.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dp.Get(); err != nil {
+		t.Fatal(err)
+	}
+	// Either shard is picked first, the full one falls through to the other
+	dp.Put(c1, false)
+	for i := 0; i < 4; i++ {
+		c, err := dp.Get()
+		if err != nil {
+			t.Fatalf("get %d: %v", i, err)
+		}
+		dp.Put(c, false)
+	}
+}
+
+func TestPoolShardTestOnBorrow(t *testing.T) {
+	f := &testFactory{}
+	conf := DefaultPoolConfig
+	conf.TestOnBorrow = true
+	conf.TestIdleThreshold = time.Minute
+	dp := NewPool([]string{"a"}, f, conf)
+	defer dp.Shutdown()
+	shard := dp.set().poolShards[0]
+
+	c, _ := dp.Get()
+	dp.Put(c, false)
+	atomic.StoreUint32(&f.invalid, 1)
+	// Idle shorter than the threshold, not tested
+	if c2, _ := dp.Get(); c2 != c {
+		t.Fatal("connection tested below threshold")
+	}
+	dp.Put(c, false)
+
+	c.setTime(time.Now().Add(-2 * time.Minute))
+	c2, err := dp.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c2 == c || !c.(*testConn).closed {
+		t.Error("failed connection not replaced")
+	}
+	stats := shard.getStats()
+	if stats.NumTest != 1 || stats.NumTestFailed != 1 || stats.NumActive != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestPoolStatsCumulative(t *testing.T) {
+	dp := NewPool([]string{"a"}, &testFactory{}, DefaultPoolConfig)
+	defer dp.Shutdown()
+	w := NewStatsWindow(dp.GetPoolStats)
+
+	for i := 0; i < 3; i++ {
+		c, _ := dp.Get()
+		dp.Put(c, false)
+	}
+	// Reading does not reset, so that readers do not interfere
+	dp.GetPoolStats()
+	stats := dp.GetPoolStats()[0]
+	if stats.NumGet != 3 || stats.NumPut != 3 || stats.NumIdle != 1 || stats.FailStreak != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	rates := w.Rates()
+	if len(rates) != 1 || rates[0].Get <= 0 || rates[0].Get != rates[0].Put || rates[0].Interval < 10*time.Millisecond {
+		t.Errorf("unexpected rates: %+v", rates)
+	}
+	if rates = w.Rates(); rates[0].Get != 0 {
+		t.Errorf("unexpected rates: %+v", rates)
+	}
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	f := &testFactory{}
+	changes := make(chan string, 10)
+	conf := DefaultPoolConfig
+	conf.MaxFails = 1
+	conf.CheckInterval = 10 * time.Millisecond
+	conf.MaxUnavailable = 0.5
+	conf.OnAvailabilityChange = func(server string, available bool) {
+		if available {
+			changes <- server + " up"
+		} else {
+			changes <- server + " down"
+		}
+	}
+	dp := NewPool([]string{"a", "b", "c", "d"}, f, conf)
+	defer dp.Shutdown()
+
+	// All down, but at most half of the shards are marked unavailable
+	atomic.StoreUint32(&f.down, 1)
+	for _, shard := range dp.set().poolShards {
+		shard.get(context.Background())
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(changes) != 2 || <-changes != "a down" || <-changes != "b down" {
+		t.Fatalf("unexpected changes %d", len(changes))
+	}
+	stats := dp.GetPoolStats()
+	if stats[0].Available || !stats[2].Available || stats[0].LastCheck.IsZero() || stats[0].FailStreak != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	atomic.StoreUint32(&f.down, 0)
+	time.Sleep(50 * time.Millisecond)
+	if len(changes) != 2 || <-changes != "a up" || <-changes != "b up" {
+		t.Errorf("unexpected changes %d", len(changes))
+	}
+}
+
+func TestPoolChangeServers(t *testing.T) {
+	dp := NewPool([]string{"a", "b"}, &testFactory{}, DefaultPoolConfig)
+	defer dp.Shutdown()
+
+	// Borrows keep going while the list changes
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if c, err := dp.Get(); err == nil {
+				dp.Put(c, false)
+			}
+			if c, err := dp.GetForKey(context.Background(), "k"); err == nil {
+				dp.Put(c, false)
+			}
+		}
+	}()
+
+	b := dp.set().poolShards[1]
+	borrowed, _ := b.get(context.Background())
+	if err := dp.AddServer("c", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := dp.AddServer("c", 1); err != ErrServerExists {
+		t.Errorf("expected exists, got %v", err)
+	}
+	if err := dp.RemoveServer("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dp.RemoveServer("b"); err != ErrServerNotFound {
+		t.Errorf("expected not found, got %v", err)
+	}
+	if err := dp.ReplaceServers([]string{"c", "d"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := dp.ReplaceServers(nil, nil); err != ErrNoServers {
+		t.Errorf("expected no servers, got %v", err)
+	}
+	close(stop)
+	<-done
+
+	if servers := dp.Servers(); len(servers) != 2 || servers[0] != "c" || servers[1] != "d" {
+		t.Errorf("unexpected servers %v", servers)
+	}
+	// The removed shard is drained, borrowed connections are closed when returned
+	if _, err := b.get(context.Background()); err == nil {
+		t.Error("borrowed from a removed shard")
+	}
+	dp.Put(borrowed, false)
+	if !borrowed.(*testConn).closed || b.getStats().NumActive != 0 {
+		t.Error("returned connection not closed")
+	}
+}
@@ -0,0 +1,95 @@
+package pool
+
+import (
+	"sync"
+	"time"
+)
+
+// PoolRates are the per second rates of the counters of a shard in the
+// interval between two calls of StatsWindow.Rates.
+type PoolRates struct {
+	Shard    string        `json:"shard"`
+	Interval time.Duration `json:"interval"`
+
+	Get         float64 `json:"get"`
+	Put         float64 `json:"put"`
+	Broken      float64 `json:"broken"`
+	Dial        float64 `json:"dial"`
+	DialError   float64 `json:"dial_error"`
+	Evict       float64 `json:"evict"`
+	Close       float64 `json:"close"`
+	Wait        float64 `json:"wait"`
+	WaitTimeout float64 `json:"wait_timeout"`
+	Test        float64 `json:"test"`
+	TestFailed  float64 `json:"test_failed"`
+	// Average time waited by the borrows which waited in the interval
+	AvgWait time.Duration `json:"avg_wait"`
+}
+
+// StatsWindow turns the cumulative counters of PoolStats into rates, every
+// observer should have its own window.
+type StatsWindow struct {
+	stats func() []PoolStats
+
+	mu   sync.Mutex
+	last map[string]PoolStats
+	at   time.Time
+}
+
+// NewStatsWindow creates a window on stats, e.g. Pool.GetPoolStats.
+func NewStatsWindow(stats func() []PoolStats) *StatsWindow {
+	w := &StatsWindow{stats: stats}
+	w.Rates()
+	return w
+}
+
+// Rates returns the rates since the previous call, or since the window is
+// created. Shards appeared meanwhile count from zero, and shards whose
+// counters went back, e.g. rebuilt on failover, are skipped.
+func (w *StatsWindow) Rates() (rates []PoolRates) {
+	now := time.Now()
+	stats := w.stats()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	interval := now.Sub(w.at)
+	last := w.last
+	w.last = make(map[string]PoolStats, len(stats))
+	w.at = now
+	for _, s := range stats {
+		w.last[s.Shard] = s
+	}
+	if last == nil || interval <= 0 {
+		return nil
+	}
+
+	for _, s := range stats {
+		prev := last[s.Shard]
+		if s.NumGet < prev.NumGet || s.NumClose < prev.NumClose {
+			continue
+		}
+		perSecond := func(cur, prev uint64) float64 {
+			return float64(cur-prev) / interval.Seconds()
+		}
+		r := PoolRates{
+			Shard:       s.Shard,
+			Interval:    interval,
+			Get:         perSecond(s.NumGet, prev.NumGet),
+			Put:         perSecond(s.NumPut, prev.NumPut),
+			Broken:      perSecond(s.NumBroken, prev.NumBroken),
+			Dial:        perSecond(s.NumDial, prev.NumDial),
+			DialError:   perSecond(s.NumDialError, prev.NumDialError),
+			Evict:       perSecond(s.NumEvict, prev.NumEvict),
+			Close:       perSecond(s.NumClose, prev.NumClose),
+			Wait:        perSecond(s.NumWait, prev.NumWait),
+			WaitTimeout: perSecond(s.NumWaitTimeout, prev.NumWaitTimeout),
+			Test:        perSecond(s.NumTest, prev.NumTest),
+			TestFailed:  perSecond(s.NumTestFailed, prev.NumTestFailed),
+		}
+		if n := s.NumWait - prev.NumWait; n > 0 {
+			r.AvgWait = (s.WaitDuration - prev.WaitDuration) / time.Duration(n)
+		}
+		rates = append(rates, r)
+	}
+	return
+}
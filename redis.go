@@ -48,4 +48,17 @@ func RedisConn(key string) (*redis.RedisPool, bool){
 		return &p, true
 	}
 	return nil, false
-}
\ No newline at end of file
+}
+//
+// rangeRedis calls f with every pool, the default one is named "default".
+//
+func rangeRedis(f func(name string, pool *redis.RedisPool)){
+	if defaultConn != nil {
+		f("default", defaultConn)
+	}
+	otherConns.Range(func(key, pool interface{}) bool{
+		p := pool.(redis.RedisPool)
+		f(key.(string), &p)
+		return true
+	})
+}
@@ -0,0 +1,422 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	// ErrCrossSlot is returned when keys of a multi-key command are in different slots,
+	// use hash tags to put them into the same slot.
+	ErrCrossSlot = errors.New("cluster: keys in request don't hash to the same slot")
+
+	ErrTooManyRedirects = errors.New("cluster: too many redirects")
+	ErrNoClusterNode    = errors.New("cluster: no node available")
+)
+
+type ClusterConfig struct {
+	// Seed nodes, e.t. []string{"127.0.0.1:7000", "127.0.0.1:7001"}
+	Addrs []string
+	// Maximum MOVED or ASK redirects followed by one command, 5 by default
+	MaxRedirects int
+	// Minimum interval between slot map refreshes, 1 second by default
+	RefreshInterval time.Duration
+}
+
+// Cluster routes commands by hash slot to a single server Pool per master node,
+// and follows MOVED and ASK redirects.
+type Cluster struct {
+	conf        ClusterConfig
+	connFactory PooledConnFactory
+	poolConfig  PoolConfig
+
+	// Guards slots and nodes
+	mu sync.RWMutex
+	// Master address of each slot, "" if unknown
+	slots [ClusterSlots]string
+	// Pools by master address
+	nodes map[string]*Pool
+
+	// @atomic unix nano of the last refresh, and whether one is running
+	lastRefresh int64
+	refreshing  uint32
+}
+
+// NewClusterPool creates a RedisPool talking to Redis Cluster, the slot map
+// is fetched from the seed nodes by CLUSTER SLOTS.
+func NewClusterPool(conf ClusterConfig, connFactory PooledConnFactory, poolConfig PoolConfig) (*RedisPool, error) {
+	if len(conf.Addrs) == 0 || connFactory == nil {
+		panic("Illegal Arguments")
+	}
+	if conf.MaxRedirects <= 0 {
+		conf.MaxRedirects = 5
+	}
+	if conf.RefreshInterval <= 0 {
+		conf.RefreshInterval = time.Second
+	}
+	scripts := newScriptSet(connFactory)
+	poolConfig = scripts.hook(poolConfig)
+	c := &Cluster{
+		conf:        conf,
+		connFactory: connFactory,
+		poolConfig:  poolConfig,
+		nodes:       make(map[string]*Pool),
+	}
+	if err := c.Refresh(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &RedisPool{cluster: c, scripts: scripts}, nil
+}
+
+// Refresh fetches the slot map from any known or seed node.
+func (c *Cluster) Refresh() (err error) {
+	atomic.StoreInt64(&c.lastRefresh, time.Now().UnixNano())
+	addrs := append(c.nodeAddrs(), c.conf.Addrs...)
+	err = ErrNoClusterNode
+	for _, addr := range addrs {
+		var slots [][]interface{}
+		if slots, err = c.clusterSlots(addr); err == nil {
+			c.applySlots(addr, slots)
+			return nil
+		}
+	}
+	return err
+}
+
+// refreshLater refreshes in background, at most once per RefreshInterval.
+func (c *Cluster) refreshLater() {
+	last := atomic.LoadInt64(&c.lastRefresh)
+	if time.Since(time.Unix(0, last)) < c.conf.RefreshInterval {
+		return
+	}
+	if !atomic.CompareAndSwapUint32(&c.refreshing, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreUint32(&c.refreshing, 0)
+		c.Refresh()
+	}()
+}
+
+func (c *Cluster) clusterSlots(addr string) ([][]interface{}, error) {
+	pc, err := c.connFactory.Create(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.connFactory.Close(pc)
+	values, err := redis.Values(pc.(*RedisPooledConnection).Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return nil, err
+	}
+	slots := make([][]interface{}, len(values))
+	for i, v := range values {
+		if slots[i], err = redis.Values(v, nil); err != nil {
+			return nil, err
+		}
+	}
+	return slots, nil
+}
+
+// applySlots updates the slot map by CLUSTER SLOTS reply, each item is
+// [start, end, [master ip, master port, ...], replicas...].
+func (c *Cluster) applySlots(from string, slots [][]interface{}) {
+	var table [ClusterSlots]string
+	for _, item := range slots {
+		if len(item) < 3 {
+			continue
+		}
+		start, _ := redis.Int(item[0], nil)
+		end, _ := redis.Int(item[1], nil)
+		master, err := redis.Values(item[2], nil)
+		if err != nil || len(master) < 2 {
+			continue
+		}
+		ip, _ := redis.String(master[0], nil)
+		port, _ := redis.Int(master[1], nil)
+		if ip == "" {
+			// Unknown endpoint, the node answering is reached by the same host
+			ip, _, _ = net.SplitHostPort(from)
+		}
+		addr := net.JoinHostPort(ip, strconv.Itoa(port))
+		for slot := start; slot <= end && slot < ClusterSlots; slot++ {
+			table[slot] = addr
+		}
+	}
+
+	c.mu.Lock()
+	c.slots = table
+	var removed []*Pool
+	for addr, p := range c.nodes {
+		if !c.ownsSlot(addr) {
+			removed = append(removed, p)
+			delete(c.nodes, addr)
+		}
+	}
+	c.mu.Unlock()
+
+	// Borrowed connections are closed when returned
+	for _, p := range removed {
+		p.Shutdown()
+	}
+}
+
+func (c *Cluster) ownsSlot(addr string) bool {
+	for _, a := range c.slots {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// masters returns the distinct masters of the slot map.
+func (c *Cluster) masters() (addrs []string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	seen := make(map[string]bool)
+	for _, addr := range c.slots {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	return
+}
+
+func (c *Cluster) nodeAddrs() (addrs []string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for addr := range c.nodes {
+		addrs = append(addrs, addr)
+	}
+	return
+}
+
+// slotAddr returns the master of slot, or a random node if slot is negative or unknown.
+func (c *Cluster) slotAddr(slot int) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if slot >= 0 && c.slots[slot] != "" {
+		return c.slots[slot]
+	}
+	for i, n := 0, rand.Intn(ClusterSlots); i < ClusterSlots; i++ {
+		if addr := c.slots[(n+i)%ClusterSlots]; addr != "" {
+			return addr
+		}
+	}
+	return ""
+}
+
+// node returns the pool of addr, creating it if needed.
+func (c *Cluster) node(addr string) *Pool {
+	c.mu.RLock()
+	p, ok := c.nodes[addr]
+	c.mu.RUnlock()
+	if ok {
+		return p
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p, ok = c.nodes[addr]; !ok {
+		p = NewPool([]string{addr}, c.connFactory, c.poolConfig)
+		c.nodes[addr] = p
+	}
+	return p
+}
+
+func (c *Cluster) conn(ctx context.Context, addr string) (*RedisPooledConnection, error) {
+	if addr == "" {
+		return nil, ErrNoClusterNode
+	}
+	dp := c.node(addr)
+	raw, err := dp.GetContext(ctx)
+	if err != nil {
+		c.refreshLater()
+		return nil, err
+	}
+	return borrowed(raw, dp, ctx), nil
+}
+
+// Get returns a connection to the master of the slot of key, it does not
+// follow redirects. Keyless commands can use any key.
+func (c *Cluster) Get(ctx context.Context, key string) redis.Conn {
+	pc, err := c.conn(ctx, c.slotAddr(Slot(key)))
+	if err != nil {
+		return errorConnection{err}
+	}
+	return pc
+}
+
+// Do sends a command to the master of its slot, following MOVED and ASK redirects.
+// The slot is found by the keys of the command, see CommandSlot.
+func (c *Cluster) Do(ctx context.Context, commandName string, args ...interface{}) (reply interface{}, err error) {
+	slot, err := CommandSlot(commandName, args...)
+	if err != nil {
+		return nil, err
+	}
+	addr := c.slotAddr(slot)
+	asking := false
+	for redirects := 0; redirects <= c.conf.MaxRedirects; redirects++ {
+		var pc *RedisPooledConnection
+		if pc, err = c.conn(ctx, addr); err != nil {
+			return nil, err
+		}
+		if asking {
+			if _, err = pc.Do("ASKING"); err != nil {
+				pc.Close()
+				return nil, err
+			}
+		}
+		reply, err = pc.Do(commandName, args...)
+		pc.Close()
+
+		rerr, ok := err.(redis.Error)
+		if !ok {
+			return reply, err
+		}
+		kind, moved, target, ok := parseRedirect(string(rerr))
+		if !ok {
+			return reply, err
+		}
+		addr, asking = target, kind == "ASK"
+		if kind == "MOVED" {
+			// The slot of the reply, which may not be the one computed locally
+			c.mu.Lock()
+			c.slots[moved] = target
+			c.mu.Unlock()
+			c.refreshLater()
+		}
+	}
+	return nil, ErrTooManyRedirects
+}
+
+// parseRedirect parses "MOVED 3999 127.0.0.1:6381" or "ASK 3999 127.0.0.1:6381".
+func parseRedirect(msg string) (kind string, slot int, addr string, ok bool) {
+	parts := strings.Fields(msg)
+	if len(parts) != 3 || (parts[0] != "MOVED" && parts[0] != "ASK") {
+		return "", 0, "", false
+	}
+	slot, err := strconv.Atoi(parts[1])
+	if err != nil || slot < 0 || slot >= ClusterSlots {
+		return "", 0, "", false
+	}
+	return parts[0], slot, parts[2], true
+}
+
+// Commands of which all arguments are keys
+var allKeysCommands = map[string]bool{
+	"DEL": true, "EXISTS": true, "MGET": true, "PFCOUNT": true, "SDIFF": true,
+	"SINTER": true, "SUNION": true, "TOUCH": true, "UNLINK": true, "WATCH": true,
+}
+
+// Commands of which the first argument is a subcommand and the second the key
+var subcommandKeyCommands = map[string]bool{
+	"MEMORY": true, "OBJECT": true, "XGROUP": true, "XINFO": true,
+}
+
+// Commands without keys, sent to any node
+var noKeyCommands = map[string]bool{
+	"CLIENT": true, "CLUSTER": true, "COMMAND": true, "CONFIG": true, "DBSIZE": true,
+	"ECHO": true, "FUNCTION": true, "INFO": true, "PING": true, "SCRIPT": true, "TIME": true,
+}
+
+// CommandSlot returns the slot of the keys of a command, which is the first
+// argument for most commands. Multi-key commands must have all keys in one
+// slot. It returns -1 for commands without keys.
+func CommandSlot(commandName string, args ...interface{}) (int, error) {
+	keys := commandKeys(strings.ToUpper(commandName), args)
+	if len(keys) == 0 {
+		return -1, nil
+	}
+	slot := Slot(keyString(keys[0]))
+	for _, key := range keys[1:] {
+		if Slot(keyString(key)) != slot {
+			return -1, ErrCrossSlot
+		}
+	}
+	return slot, nil
+}
+
+// commandKeys returns the keys among args of cmd.
+func commandKeys(cmd string, args []interface{}) []interface{} {
+	switch {
+	case len(args) == 0 || noKeyCommands[cmd]:
+		return nil
+	case allKeysCommands[cmd]:
+		return args
+	case cmd == "MSET" || cmd == "MSETNX":
+		keys := make([]interface{}, 0, (len(args)+1)/2)
+		for i := 0; i < len(args); i += 2 {
+			keys = append(keys, args[i])
+		}
+		return keys
+	case cmd == "EVAL" || cmd == "EVALSHA" || cmd == "EVAL_RO" || cmd == "EVALSHA_RO":
+		// script numkeys key [key ...] arg [arg ...]
+		if len(args) < 2 {
+			return nil
+		}
+		n, err := strconv.Atoi(keyString(args[1]))
+		if err != nil || n < 0 || n > len(args)-2 {
+			return nil
+		}
+		return args[2 : 2+n]
+	case subcommandKeyCommands[cmd]:
+		if len(args) < 2 {
+			return nil
+		}
+		return args[1:2]
+	case cmd == "XREAD" || cmd == "XREADGROUP":
+		// ... STREAMS key [key ...] id [id ...]
+		for i, arg := range args {
+			if strings.ToUpper(keyString(arg)) == "STREAMS" {
+				streams := args[i+1:]
+				return streams[:len(streams)/2]
+			}
+		}
+		return nil
+	}
+	return args[:1]
+}
+
+func keyString(arg interface{}) string {
+	switch k := arg.(type) {
+	case string:
+		return k
+	case []byte:
+		return string(k)
+	}
+	return fmt.Sprint(arg)
+}
+
+// GetPoolStats returns the stats of all node pools.
+func (c *Cluster) GetPoolStats() (stats []PoolStats) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, p := range c.nodes {
+		stats = append(stats, p.GetPoolStats()...)
+	}
+	return
+}
+
+// Close shuts down all node pools.
+func (c *Cluster) Close() {
+	c.mu.Lock()
+	nodes := c.nodes
+	c.nodes = make(map[string]*Pool)
+	c.mu.Unlock()
+	for _, p := range nodes {
+		p.Shutdown()
+	}
+}
@@ -0,0 +1,172 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/feekk/zddgo/redis/redistest"
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestSlot(t *testing.T) {
+	if crc16("123456789") != 0x31C3 {
+		t.Errorf("crc16 %x", crc16("123456789"))
+	}
+	if Slot("foo") != 12182 {
+		t.Errorf("slot of foo %d", Slot("foo"))
+	}
+	if Slot("{user1000}.following") != Slot("{user1000}.followers") || Slot("{user1000}.following") != Slot("user1000") {
+		t.Error("hash tag ignored")
+	}
+	if Slot("foo{}{bar}") != int(crc16("foo{}{bar}"))%ClusterSlots {
+		t.Error("empty hash tag should hash the whole key")
+	}
+	if _, err := CommandSlot("MGET", "{a}1", "{a}2"); err != nil {
+		t.Error(err)
+	}
+	if _, err := CommandSlot("MSET", "{a}1", "v", "{b}2", "v"); err != ErrCrossSlot {
+		t.Errorf("expected cross slot, got %v", err)
+	}
+	for _, c := range []struct {
+		name string
+		args []interface{}
+		slot int
+	}{
+		{"EVAL", []interface{}{"return 1", 2, "{a}1", "{a}2", "arg"}, Slot("a")},
+		{"evalsha", []interface{}{"abc", "0", "arg"}, -1},
+		{"XGROUP", []interface{}{"CREATE", "jobs", "g", "$"}, Slot("jobs")},
+		{"XREADGROUP", []interface{}{"GROUP", "g", "w", "STREAMS", "jobs", ">"}, Slot("jobs")},
+		{"PING", []interface{}{"hello"}, -1},
+	} {
+		if slot, err := CommandSlot(c.name, c.args...); err != nil || slot != c.slot {
+			t.Errorf("slot of %s = %d, %v", c.name, slot, err)
+		}
+	}
+}
+
+func TestClusterRedirect(t *testing.T) {
+	a, b := redistest.NewServer(), redistest.NewServer()
+	defer a.Close()
+	defer b.Close()
+	// Node a owns all slots until "moved" is migrated to b, "ask" is migrating
+	host, port, _ := net.SplitHostPort(a.Addr())
+	portNum, _ := strconv.Atoi(port)
+	slots := func(args []string) interface{} {
+		return []interface{}{[]interface{}{0, ClusterSlots - 1, []interface{}{host, portNum}}}
+	}
+	redirect := func(kind, key string, to *redistest.Server) redistest.Error {
+		return redistest.Error(fmt.Sprintf("%s %d %s", kind, Slot(key), to.Addr()))
+	}
+	a.Handle("CLUSTER", slots)
+	a.Handle("GET", func(args []string) interface{} {
+		switch args[0] {
+		case "moved":
+			return redirect("MOVED", "moved", b)
+		case "ask":
+			return redirect("ASK", "ask", b)
+		}
+		return "a:" + args[0]
+	})
+	// Redirected by the slot of the key, not of the script
+	a.Handle("EVAL", func(args []string) interface{} {
+		return redirect("MOVED", "script-key", b)
+	})
+	b.Handle("CLUSTER", slots)
+	// Only one client at a time in this test, no need to track ASKING per connection
+	asking := false
+	b.Handle("ASKING", func(args []string) interface{} {
+		asking = true
+		return redistest.Status("OK")
+	})
+	b.Handle("GET", func(args []string) interface{} {
+		if args[0] == "ask" && !asking {
+			return redirect("MOVED", "ask", a)
+		}
+		asking = false
+		return "b:" + args[0]
+	})
+	b.Handle("EVAL", func(args []string) interface{} {
+		return redistest.Status("OK")
+	})
+
+	p, err := NewClusterPool(ClusterConfig{Addrs: []string{"127.0.0.1:1", a.Addr()}}, DefaultRedisPooledConnFactory, DefaultPoolConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	c := p.Cluster()
+	ctx := context.Background()
+
+	for key, want := range map[string]string{"foo": "a:foo", "moved": "b:moved", "ask": "b:ask"} {
+		if v, err := redis.String(c.Do(ctx, "GET", key)); err != nil || v != want {
+			t.Errorf("GET %s = %q, %v", key, v, err)
+		}
+	}
+	if _, err := c.Do(ctx, "EVAL", "return 1", 1, "script-key"); err != nil {
+		t.Errorf("EVAL %v", err)
+	}
+	if addr := c.slotAddr(Slot("return 1")); addr != a.Addr() {
+		t.Errorf("slot of the script body moved to %s", addr)
+	}
+	// MOVED updates the slot, ASK does not
+	if addr := c.slotAddr(Slot("moved")); addr != b.Addr() || c.slotAddr(Slot("script-key")) != b.Addr() {
+		t.Errorf("moved slot at %s", addr)
+	}
+	if addr := c.slotAddr(Slot("ask")); addr != a.Addr() {
+		t.Errorf("ask slot at %s", addr)
+	}
+
+	conn := p.GetForKey("foo")
+	if v, err := redis.String(conn.Do("GET", "foo")); err != nil || v != "a:foo" {
+		t.Errorf("GetForKey GET = %q, %v", v, err)
+	}
+	conn.Close()
+
+	if _, err := c.Do(ctx, "DEL", "k1", "k2"); err != ErrCrossSlot {
+		t.Errorf("expected cross slot, got %v", err)
+	}
+}
+
+func TestClusterKeyless(t *testing.T) {
+	a, b := redistest.NewServer(), redistest.NewServer()
+	defer a.Close()
+	defer b.Close()
+	node := func(s *redistest.Server) []interface{} {
+		host, port, _ := net.SplitHostPort(s.Addr())
+		portNum, _ := strconv.Atoi(port)
+		return []interface{}{host, portNum}
+	}
+	slots := func(args []string) interface{} {
+		return []interface{}{
+			[]interface{}{0, ClusterSlots/2 - 1, node(a)},
+			[]interface{}{ClusterSlots / 2, ClusterSlots - 1, node(b)},
+		}
+	}
+	for name, s := range map[string]*redistest.Server{"a": a, "b": b} {
+		name := name
+		s.Handle("CLUSTER", slots)
+		s.Handle("INFO", func(args []string) interface{} { return name })
+	}
+
+	p, err := NewClusterPool(ClusterConfig{Addrs: []string{a.Addr()}}, DefaultRedisPooledConnFactory, DefaultPoolConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	seen := map[string]bool{}
+	for i := 0; i < 50; i++ {
+		conn := p.GetContext(context.Background())
+		name, err := redis.String(conn.Do("INFO"))
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[name] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("keyless commands sent to %v only", seen)
+	}
+}
@@ -0,0 +1,415 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ErrNotFound is returned by Cmd when the key, field or member does not exist.
+var ErrNotFound = errors.New("redis: not found")
+
+// Cmd is the typed command API of a RedisPool. Every call borrows a
+// connection and returns it before returning, so that no pool slot leaks.
+//
+// Commands are sent to the shard owning their first key, see GetForKey.
+// Multi-key commands sent with Do must have all keys on one shard, or in one
+// slot in cluster mode, else ErrCrossShard or ErrCrossSlot is returned. MGet
+// and Del split their keys and send one command per shard or slot.
+type Cmd struct {
+	p *RedisPool
+}
+
+func (p *RedisPool) Cmd() *Cmd {
+	return &Cmd{p: p}
+}
+
+// Z is a member of a sorted set with its score.
+type Z struct {
+	Score  float64
+	Member string
+}
+
+// Do sends any command to the shard of its keys, see CommandSlot for how
+// the keys are found among args.
+func (c *Cmd) Do(ctx context.Context, commandName string, args ...interface{}) (reply interface{}, err error) {
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	if c.p.cluster != nil {
+		return c.p.cluster.Do(ctx, commandName, args...)
+	}
+	var conn redis.Conn
+	if keys := commandKeys(strings.ToUpper(commandName), args); len(keys) > 0 {
+		key := keyString(keys[0])
+		if len(keys) > 1 {
+			others := make([]string, len(keys)-1)
+			for i, k := range keys[1:] {
+				others[i] = keyString(k)
+			}
+			if err = c.sameServer(key, others); err != nil {
+				return nil, err
+			}
+		}
+		conn = c.p.GetForKeyContext(ctx, key)
+	} else {
+		conn = c.p.GetContext(ctx)
+	}
+	defer conn.Close()
+	return conn.Do(commandName, args...)
+}
+
+// splitKeys groups keys by shard, or by slot in cluster mode, keeping their
+// order within a group.
+func (c *Cmd) splitKeys(keys []string) ([][]string, error) {
+	if c.p.cluster == nil && len(c.p.pool().Shards()) < 2 {
+		return [][]string{keys}, nil
+	}
+	var groups [][]string
+	index := make(map[interface{}]int)
+	for _, key := range keys {
+		var group interface{}
+		if c.p.cluster != nil {
+			group = Slot(key)
+		} else {
+			shard, err := c.p.pool().ShardForKey(key)
+			if err != nil {
+				return nil, err
+			}
+			group = shard
+		}
+		i, ok := index[group]
+		if !ok {
+			i = len(groups)
+			index[group] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], key)
+	}
+	return groups, nil
+}
+
+// notFound maps redis.ErrNil of reply helpers to ErrNotFound.
+func notFound(err error) error {
+	if err == redis.ErrNil {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (c *Cmd) str(ctx context.Context, commandName string, args ...interface{}) (string, error) {
+	v, err := redis.String(c.Do(ctx, commandName, args...))
+	return v, notFound(err)
+}
+
+func (c *Cmd) int64(ctx context.Context, commandName string, args ...interface{}) (int64, error) {
+	v, err := redis.Int64(c.Do(ctx, commandName, args...))
+	return v, notFound(err)
+}
+
+func (c *Cmd) bool(ctx context.Context, commandName string, args ...interface{}) (bool, error) {
+	v, err := redis.Bool(c.Do(ctx, commandName, args...))
+	return v, notFound(err)
+}
+
+func (c *Cmd) float64(ctx context.Context, commandName string, args ...interface{}) (float64, error) {
+	v, err := redis.Float64(c.Do(ctx, commandName, args...))
+	return v, notFound(err)
+}
+
+func (c *Cmd) strings(ctx context.Context, commandName string, args ...interface{}) ([]string, error) {
+	return redis.Strings(c.Do(ctx, commandName, args...))
+}
+
+func (c *Cmd) ok(ctx context.Context, commandName string, args ...interface{}) error {
+	_, err := c.Do(ctx, commandName, args...)
+	return err
+}
+
+// Strings
+
+func (c *Cmd) Get(ctx context.Context, key string) (string, error) {
+	return c.str(ctx, "GET", key)
+}
+
+func (c *Cmd) GetBytes(ctx context.Context, key string) ([]byte, error) {
+	v, err := redis.Bytes(c.Do(ctx, "GET", key))
+	return v, notFound(err)
+}
+
+func (c *Cmd) GetInt64(ctx context.Context, key string) (int64, error) {
+	return c.int64(ctx, "GET", key)
+}
+
+// Set sets key to value, it never expires if ttl is zero.
+func (c *Cmd) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	if ttl > 0 {
+		return c.ok(ctx, "SET", key, value, "PX", ttlMillis(ttl))
+	}
+	return c.ok(ctx, "SET", key, value)
+}
+
+// SetNX sets key only if it does not exist, and reports whether it is set.
+func (c *Cmd) SetNX(ctx context.Context, key string, value interface{}, ttl time.Duration) (bool, error) {
+	args := []interface{}{key, value, "NX"}
+	if ttl > 0 {
+		args = append(args, "PX", ttlMillis(ttl))
+	}
+	reply, err := c.Do(ctx, "SET", args...)
+	if err != nil {
+		return false, err
+	}
+	return reply != nil, nil
+}
+
+// MGet returns the values of keys, missing keys are absent from the map.
+func (c *Cmd) MGet(ctx context.Context, keys ...string) (map[string]string, error) {
+	groups, err := c.splitKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]string, len(keys))
+	for _, group := range groups {
+		values, err := redis.Values(c.Do(ctx, "MGET", redis.Args{}.AddFlat(group)...))
+		if err != nil {
+			return nil, err
+		}
+		for i, v := range values {
+			if v != nil && i < len(group) {
+				m[group[i]], _ = redis.String(v, nil)
+			}
+		}
+	}
+	return m, nil
+}
+
+func (c *Cmd) Incr(ctx context.Context, key string) (int64, error) {
+	return c.int64(ctx, "INCR", key)
+}
+
+func (c *Cmd) IncrBy(ctx context.Context, key string, n int64) (int64, error) {
+	return c.int64(ctx, "INCRBY", key, n)
+}
+
+// Del deletes keys and returns how many existed. On error, the keys of the
+// shards before the failing one may already be deleted.
+func (c *Cmd) Del(ctx context.Context, keys ...string) (int64, error) {
+	groups, err := c.splitKeys(keys)
+	if err != nil {
+		return 0, err
+	}
+	var deleted int64
+	for _, group := range groups {
+		n, err := c.int64(ctx, "DEL", redis.Args{}.AddFlat(group)...)
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+	return deleted, nil
+}
+
+func (c *Cmd) Exists(ctx context.Context, key string) (bool, error) {
+	return c.bool(ctx, "EXISTS", key)
+}
+
+// TTLs
+
+// Expire reports whether the timeout is set, false if key does not exist.
+func (c *Cmd) Expire(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	return c.bool(ctx, "PEXPIRE", key, ttlMillis(ttl))
+}
+
+func (c *Cmd) Persist(ctx context.Context, key string) (bool, error) {
+	return c.bool(ctx, "PERSIST", key)
+}
+
+// TTL returns the remaining time to live, -1 if key never expires and
+// ErrNotFound if key does not exist.
+func (c *Cmd) TTL(ctx context.Context, key string) (time.Duration, error) {
+	ms, err := c.int64(ctx, "PTTL", key)
+	switch {
+	case err != nil:
+		return 0, err
+	case ms == -2:
+		return 0, ErrNotFound
+	case ms == -1:
+		return -1, nil
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// Hashes
+
+func (c *Cmd) HGet(ctx context.Context, key, field string) (string, error) {
+	return c.str(ctx, "HGET", key, field)
+}
+
+// HSet reports whether field is new.
+func (c *Cmd) HSet(ctx context.Context, key, field string, value interface{}) (bool, error) {
+	return c.bool(ctx, "HSET", key, field, value)
+}
+
+func (c *Cmd) HMSet(ctx context.Context, key string, fields map[string]interface{}) error {
+	return c.ok(ctx, "HMSET", redis.Args{key}.AddFlat(fields)...)
+}
+
+// HMGet returns the values of fields, missing fields are absent from the map.
+func (c *Cmd) HMGet(ctx context.Context, key string, fields ...string) (map[string]string, error) {
+	values, err := redis.Values(c.Do(ctx, "HMGET", redis.Args{key}.AddFlat(fields)...))
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]string, len(fields))
+	for i, v := range values {
+		if v != nil && i < len(fields) {
+			m[fields[i]], _ = redis.String(v, nil)
+		}
+	}
+	return m, nil
+}
+
+func (c *Cmd) HGetAll(ctx context.Context, key string) (map[string]string, error) {
+	return redis.StringMap(c.Do(ctx, "HGETALL", key))
+}
+
+func (c *Cmd) HDel(ctx context.Context, key string, fields ...string) (int64, error) {
+	return c.int64(ctx, "HDEL", redis.Args{key}.AddFlat(fields)...)
+}
+
+func (c *Cmd) HIncrBy(ctx context.Context, key, field string, n int64) (int64, error) {
+	return c.int64(ctx, "HINCRBY", key, field, n)
+}
+
+func (c *Cmd) HExists(ctx context.Context, key, field string) (bool, error) {
+	return c.bool(ctx, "HEXISTS", key, field)
+}
+
+func (c *Cmd) HLen(ctx context.Context, key string) (int64, error) {
+	return c.int64(ctx, "HLEN", key)
+}
+
+// Lists
+
+func (c *Cmd) LPush(ctx context.Context, key string, values ...interface{}) (int64, error) {
+	return c.int64(ctx, "LPUSH", redis.Args{key}.Add(values...)...)
+}
+
+func (c *Cmd) RPush(ctx context.Context, key string, values ...interface{}) (int64, error) {
+	return c.int64(ctx, "RPUSH", redis.Args{key}.Add(values...)...)
+}
+
+func (c *Cmd) LPop(ctx context.Context, key string) (string, error) {
+	return c.str(ctx, "LPOP", key)
+}
+
+func (c *Cmd) RPop(ctx context.Context, key string) (string, error) {
+	return c.str(ctx, "RPOP", key)
+}
+
+func (c *Cmd) LRange(ctx context.Context, key string, start, stop int64) ([]string, error) {
+	return c.strings(ctx, "LRANGE", key, start, stop)
+}
+
+func (c *Cmd) LLen(ctx context.Context, key string) (int64, error) {
+	return c.int64(ctx, "LLEN", key)
+}
+
+func (c *Cmd) LTrim(ctx context.Context, key string, start, stop int64) error {
+	return c.ok(ctx, "LTRIM", key, start, stop)
+}
+
+// Sets
+
+func (c *Cmd) SAdd(ctx context.Context, key string, members ...interface{}) (int64, error) {
+	return c.int64(ctx, "SADD", redis.Args{key}.Add(members...)...)
+}
+
+func (c *Cmd) SRem(ctx context.Context, key string, members ...interface{}) (int64, error) {
+	return c.int64(ctx, "SREM", redis.Args{key}.Add(members...)...)
+}
+
+func (c *Cmd) SMembers(ctx context.Context, key string) ([]string, error) {
+	return c.strings(ctx, "SMEMBERS", key)
+}
+
+func (c *Cmd) SIsMember(ctx context.Context, key string, member interface{}) (bool, error) {
+	return c.bool(ctx, "SISMEMBER", key, member)
+}
+
+func (c *Cmd) SCard(ctx context.Context, key string) (int64, error) {
+	return c.int64(ctx, "SCARD", key)
+}
+
+// Sorted sets
+
+func (c *Cmd) ZAdd(ctx context.Context, key string, members ...Z) (int64, error) {
+	args := redis.Args{key}
+	for _, z := range members {
+		args = args.Add(z.Score, z.Member)
+	}
+	return c.int64(ctx, "ZADD", args...)
+}
+
+func (c *Cmd) ZRem(ctx context.Context, key string, members ...interface{}) (int64, error) {
+	return c.int64(ctx, "ZREM", redis.Args{key}.Add(members...)...)
+}
+
+func (c *Cmd) ZScore(ctx context.Context, key string, member interface{}) (float64, error) {
+	return c.float64(ctx, "ZSCORE", key, member)
+}
+
+func (c *Cmd) ZIncrBy(ctx context.Context, key string, increment float64, member interface{}) (float64, error) {
+	return c.float64(ctx, "ZINCRBY", key, increment, member)
+}
+
+func (c *Cmd) ZRank(ctx context.Context, key string, member interface{}) (int64, error) {
+	return c.int64(ctx, "ZRANK", key, member)
+}
+
+func (c *Cmd) ZCard(ctx context.Context, key string) (int64, error) {
+	return c.int64(ctx, "ZCARD", key)
+}
+
+func (c *Cmd) ZRange(ctx context.Context, key string, start, stop int64) ([]string, error) {
+	return c.strings(ctx, "ZRANGE", key, start, stop)
+}
+
+func (c *Cmd) ZRangeWithScores(ctx context.Context, key string, start, stop int64) ([]Z, error) {
+	return zs(c.Do(ctx, "ZRANGE", key, start, stop, "WITHSCORES"))
+}
+
+// ZRangeByScore returns members with min <= score <= max, min and max may
+// be "-inf", "+inf" or exclusive like "(1".
+func (c *Cmd) ZRangeByScore(ctx context.Context, key, min, max string) ([]string, error) {
+	return c.strings(ctx, "ZRANGEBYSCORE", key, min, max)
+}
+
+func zs(reply interface{}, err error) ([]Z, error) {
+	values, err := redis.Strings(reply, err)
+	if err != nil {
+		return nil, err
+	}
+	members := make([]Z, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		score, err := strconv.ParseFloat(values[i+1], 64)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, Z{Score: score, Member: values[i]})
+	}
+	return members, nil
+}
+
+// ttlMillis rounds ttl up to milliseconds, so that a positive ttl never becomes 0.
+func ttlMillis(ttl time.Duration) int64 {
+	ms := int64(ttl / time.Millisecond)
+	if ttl%time.Millisecond != 0 {
+		ms++
+	}
+	return ms
+}
@@ -0,0 +1,121 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/feekk/zddgo/redis/redistest"
+)
+
+func newTestCmd(t *testing.T) (*Cmd, func()) {
+	s := redistest.NewServer()
+	p := NewRedisPool([]string{s.Addr()}, DefaultRedisPooledConnFactory, DefaultPoolConfig)
+	return p.Cmd(), func() {
+		p.Close()
+		s.Close()
+	}
+}
+
+func TestCmd(t *testing.T) {
+	c, closer := newTestCmd(t)
+	defer closer()
+	ctx := context.Background()
+
+	if _, err := c.Get(ctx, "missing"); err != ErrNotFound {
+		t.Errorf("expected not found, got %v", err)
+	}
+	if _, err := c.TTL(ctx, "missing"); err != ErrNotFound {
+		t.Errorf("expected not found, got %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := c.Set(ctx, fmt.Sprintf("k%d", i), i, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, err := c.GetInt64(ctx, "k3"); err != nil || v != 3 {
+		t.Errorf("GetInt64 = %d, %v", v, err)
+	}
+
+	var keys []string
+	it := c.Scan(ctx, "k*", 2)
+	for it.Next() {
+		keys = append(keys, it.Val())
+	}
+	if it.Err() != nil || len(keys) != 5 {
+		t.Errorf("scan %v, %v", keys, it.Err())
+	}
+
+	stats := c.p.GetPoolStats()
+	if stats[0].NumActive != 1 || stats[0].NumGet != stats[0].NumPut {
+		t.Errorf("connection leaked %+v", stats[0])
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := c.Get(cctx, "k1"); err != context.Canceled {
+		t.Errorf("expected canceled, got %v", err)
+	}
+}
+
+func TestCmdScanShards(t *testing.T) {
+	a, b := redistest.NewServer(), redistest.NewServer()
+	defer a.Close()
+	defer b.Close()
+	p := NewRedisPool([]string{a.Addr(), b.Addr()}, DefaultRedisPooledConnFactory, DefaultPoolConfig)
+	defer p.Close()
+	c := p.Cmd()
+	ctx := context.Background()
+
+	for i := 0; i < 20; i++ {
+		if err := c.Set(ctx, fmt.Sprintf("k%d", i), i, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(a.Keys()) == 0 || len(b.Keys()) == 0 {
+		t.Fatalf("keys not spread, %d and %d", len(a.Keys()), len(b.Keys()))
+	}
+	seen := map[string]bool{}
+	it := c.Scan(ctx, "", 5)
+	for it.Next() {
+		seen[it.Val()] = true
+	}
+	if it.Err() != nil || len(seen) != 20 {
+		t.Errorf("scanned %d keys, %v", len(seen), it.Err())
+	}
+}
+
+func TestCmdMultiKeyShards(t *testing.T) {
+	a, b := redistest.NewServer(), redistest.NewServer()
+	defer a.Close()
+	defer b.Close()
+	p := NewRedisPool([]string{a.Addr(), b.Addr()}, DefaultRedisPooledConnFactory, DefaultPoolConfig)
+	defer p.Close()
+	c := p.Cmd()
+	ctx := context.Background()
+
+	var keys []interface{}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if err := c.Set(ctx, key, i, 0); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	if _, err := c.Do(ctx, "MGET", keys...); err != ErrCrossShard {
+		t.Errorf("expected cross shard, got %v", err)
+	}
+
+	m, err := c.MGet(ctx, "k0", "k1", "k2", "k3", "k4", "missing")
+	if err != nil || len(m) != 5 || m["k3"] != "3" {
+		t.Errorf("MGet = %v, %v", m, err)
+	}
+	n, err := c.Del(ctx, "k0", "k1", "k2", "k3", "k4", "k5", "k6", "k7", "k8", "k9", "missing")
+	if err != nil || n != 10 {
+		t.Errorf("Del = %d, %v", n, err)
+	}
+	if len(a.Keys())+len(b.Keys()) != 10 {
+		t.Errorf("%d and %d keys left", len(a.Keys()), len(b.Keys()))
+	}
+}
@@ -0,0 +1,44 @@
+package redis
+
+import (
+	"strings"
+)
+
+// Number of hash slots of Redis Cluster
+const ClusterSlots = 16384
+
+// crc16 table of CRC16-CCITT (XMODEM), as used by Redis Cluster
+var crc16tab [256]uint16
+
+func init() {
+	for i := 0; i < 256; i++ {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		crc16tab[i] = crc
+	}
+}
+
+func crc16(s string) (crc uint16) {
+	for i := 0; i < len(s); i++ {
+		crc = crc<<8 ^ crc16tab[byte(crc>>8)^s[i]]
+	}
+	return
+}
+
+// Slot returns the hash slot of key. If key contains a non empty hash tag
+// like "{user1000}.following", only the tag is hashed, so that keys sharing
+// the tag are in the same slot.
+func Slot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) % ClusterSlots
+}
@@ -0,0 +1,315 @@
+package redis
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ErrNotObtained is returned when the lock is held by another owner.
+var ErrNotObtained = errors.New("lock: not obtained")
+
+// ErrLockNotHeld is returned when releasing or extending a lock which is
+// expired or taken over by another owner.
+var ErrLockNotHeld = errors.New("lock: not held")
+
+// Compare the owner token before deleting or extending, so that a lock
+// expired and acquired by another owner is never touched.
+var (
+	releaseScript = NewScript(1, `
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`)
+	extendScript = NewScript(1, `
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0`)
+)
+
+type LockOptions struct {
+	// Lease of the lock, expired if the owner does not release or extend it.
+	// 10 seconds by default, it must exceed the clock drift allowance of 2ms
+	TTL time.Duration
+	// Wait between tries of Lock, 50ms by default
+	RetryInterval time.Duration
+	// Extend the lease every TTL/3 until released
+	AutoRenew bool
+	// Redlock mode, the lock is held if acquired on a majority of the shards
+	// of the pool in time. Ignored in cluster mode, where the key has one master.
+	Quorum bool
+}
+
+// Lock is a lock on a key obtained by Locker.
+type Lock struct {
+	locker *Locker
+	key    string
+	token  string
+
+	// Guards released and until
+	mu       sync.Mutex
+	released bool
+	// Time the lease expires at, as known by the owner
+	until time.Time
+
+	// Closed when the lease is lost while auto renewing
+	lost    chan struct{}
+	stopper chan struct{}
+	wg      sync.WaitGroup
+}
+
+// Locker obtains locks on a RedisPool, it is safe for concurrent use.
+type Locker struct {
+	p    *RedisPool
+	opts LockOptions
+}
+
+// Locker returns a Locker obtaining locks with opts.
+func (p *RedisPool) Locker(opts LockOptions) *Locker {
+	if opts.TTL <= 0 {
+		opts.TTL = 10 * time.Second
+	}
+	if opts.TTL <= drift(opts.TTL) {
+		panic("Illegal Arguments")
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = 50 * time.Millisecond
+	}
+	return &Locker{p: p, opts: opts}
+}
+
+// TryLock tries to obtain the lock on key once, ErrNotObtained is returned
+// if it is held by another owner.
+func (lk *Locker) TryLock(ctx context.Context, key string) (*Lock, error) {
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	l := &Lock{
+		locker:  lk,
+		key:     key,
+		token:   token,
+		lost:    make(chan struct{}),
+		stopper: make(chan struct{}),
+	}
+	if err = l.acquire(ctx); err != nil {
+		return nil, err
+	}
+	if lk.opts.AutoRenew {
+		l.wg.Add(1)
+		go l.goRenew()
+	}
+	return l, nil
+}
+
+// Lock obtains the lock on key, retrying until ctx is done. Errors of the
+// servers are retried too.
+func (lk *Locker) Lock(ctx context.Context, key string) (*Lock, error) {
+	for {
+		l, err := lk.TryLock(ctx, key)
+		if err == nil {
+			return l, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lk.opts.RetryInterval):
+		}
+	}
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// conns returns a connection to every shard in quorum mode, or to the shard
+// owning key. Connections of unavailable shards are broken.
+func (lk *Locker) conns(ctx context.Context, key string) (conns []redis.Conn) {
+	if !lk.opts.Quorum || lk.p.cluster != nil {
+		return []redis.Conn{lk.p.GetForKeyContext(ctx, key)}
+	}
+	dp := lk.p.pool()
+	for _, shard := range dp.Shards() {
+		if !shard.Available() {
+			conns = append(conns, errorConnection{ErrNoAvailableShard})
+			continue
+		}
+		raw, err := shard.Get(ctx)
+		if err != nil {
+			conns = append(conns, errorConnection{err})
+			continue
+		}
+		conns = append(conns, borrowed(raw, dp, ctx))
+	}
+	return
+}
+
+// eval runs f on the instances of the lock, and returns whether a majority
+// succeeded within the lease, together with the new lease end.
+func (l *Lock) eval(ctx context.Context, ttl time.Duration, f func(c redis.Conn) (bool, error)) (ok bool, until time.Time, err error) {
+	start := time.Now()
+	conns := l.locker.conns(ctx, l.key)
+	n := 0
+	for _, c := range conns {
+		var done bool
+		if done, err = f(c); done {
+			n++
+		}
+		c.Close()
+	}
+	until = start.Add(ttl - drift(ttl))
+	if n >= len(conns)/2+1 && time.Now().Before(until) {
+		return true, until, nil
+	}
+	return false, until, err
+}
+
+// drift is the clock drift between the servers allowed in a lease of ttl,
+// as suggested by Redlock.
+func drift(ttl time.Duration) time.Duration {
+	return ttl/100 + 2*time.Millisecond
+}
+
+func (l *Lock) acquire(ctx context.Context) error {
+	ttl := l.locker.opts.TTL
+	held := false
+	acquired := 0
+	ok, until, err := l.eval(ctx, ttl, func(c redis.Conn) (bool, error) {
+		_, err := redis.String(c.Do("SET", l.key, l.token, "NX", "PX", ttlMillis(ttl)))
+		if err == redis.ErrNil {
+			held = true
+		}
+		if err == nil {
+			acquired++
+		}
+		return err == nil, err
+	})
+	if ok {
+		l.until = until
+		return nil
+	}
+	// Undo the partial acquirement in quorum mode, or an acquirement too late,
+	// there is nothing to undo if the lock is held by another owner
+	if acquired > 0 {
+		l.release(ctx)
+	}
+	if held || err == nil {
+		err = ErrNotObtained
+	}
+	return err
+}
+
+// Key returns the locked key.
+func (l *Lock) Key() string {
+	return l.key
+}
+
+// Token returns the unique owner token stored in the key.
+func (l *Lock) Token() string {
+	return l.token
+}
+
+// Until returns the time the lease expires at, if not extended.
+func (l *Lock) Until() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.until
+}
+
+// Lost returns a channel closed when auto renewal fails to extend the lease
+// in time, and the lock may be taken by another owner.
+func (l *Lock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Extend resets the lease to ttl, if the lock is still held.
+func (l *Lock) Extend(ctx context.Context, ttl time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.released {
+		return ErrLockNotHeld
+	}
+	ok, until, err := l.eval(ctx, ttl, func(c redis.Conn) (bool, error) {
+		n, err := redis.Int(extendScript.Do(c, l.key, l.token, ttlMillis(ttl)))
+		return n == 1, err
+	})
+	if !ok {
+		if err == nil {
+			err = ErrLockNotHeld
+		}
+		return err
+	}
+	l.until = until
+	return nil
+}
+
+// Release stops renewing and deletes the key if still owned.
+func (l *Lock) Release(ctx context.Context) error {
+	l.mu.Lock()
+	if l.released {
+		l.mu.Unlock()
+		return ErrLockNotHeld
+	}
+	l.released = true
+	close(l.stopper)
+	l.mu.Unlock()
+
+	l.wg.Wait()
+	if !l.release(ctx) {
+		return ErrLockNotHeld
+	}
+	return nil
+}
+
+// release deletes the key on all instances, and returns whether a majority did.
+func (l *Lock) release(ctx context.Context) bool {
+	deleted := 0
+	conns := l.locker.conns(ctx, l.key)
+	for _, c := range conns {
+		if n, _ := redis.Int(releaseScript.Do(c, l.key, l.token)); n == 1 {
+			deleted++
+		}
+		c.Close()
+	}
+	return deleted >= len(conns)/2+1
+}
+
+// goRenew extends the lease every TTL/3, failures are retried on the next
+// tick until the lease ends.
+func (l *Lock) goRenew() {
+	defer l.wg.Done()
+	ttl := l.locker.opts.TTL
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stopper:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), ttl/3)
+		err := l.Extend(ctx, ttl)
+		cancel()
+		select {
+		case <-l.stopper:
+			// Released meanwhile
+			return
+		default:
+		}
+		if err == ErrLockNotHeld || (err != nil && time.Now().After(l.Until())) {
+			close(l.lost)
+			return
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package redis
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/feekk/zddgo/redis/redistest"
+)
+
+// newLockServer serves the commands used by Lock, scripts are told apart by
+// their body and never cached, so that EVAL is used after NOSCRIPT. evals
+// returns the number of scripts run.
+func newLockServer() (s *redistest.Server, evals func() int32) {
+	data := map[string]string{}
+	var n int32
+	s = redistest.NewServer()
+	s.Handle("SET", func(args []string) interface{} {
+		if _, ok := data[args[0]]; ok {
+			return nil
+		}
+		data[args[0]] = args[1]
+		return redistest.Status("OK")
+	})
+	s.Handle("EVALSHA", func(args []string) interface{} {
+		return redistest.Error("NOSCRIPT No matching script")
+	})
+	s.Handle("EVAL", func(args []string) interface{} {
+		atomic.AddInt32(&n, 1)
+		if data[args[2]] != args[3] {
+			return 0
+		}
+		if strings.Contains(args[0], `"del"`) {
+			delete(data, args[2])
+		}
+		return 1
+	})
+	return s, func() int32 { return atomic.LoadInt32(&n) }
+}
+
+func TestLock(t *testing.T) {
+	s, evals := newLockServer()
+	defer s.Close()
+	p := NewRedisPool([]string{s.Addr()}, DefaultRedisPooledConnFactory, DefaultPoolConfig)
+	defer p.Close()
+	lk := p.Locker(LockOptions{TTL: 300 * time.Millisecond, RetryInterval: 10 * time.Millisecond, AutoRenew: true})
+	ctx := context.Background()
+
+	l, err := lk.TryLock(ctx, "job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := evals()
+	if _, err = lk.TryLock(ctx, "job"); err != ErrNotObtained {
+		t.Fatalf("got %v", err)
+	}
+	// Nothing to undo without quorum
+	if evals() != n {
+		t.Fatal("released after a failed try")
+	}
+
+	// Held across several leases by renewal
+	timeout, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	_, err = lk.Lock(timeout, "job")
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got %v", err)
+	}
+	select {
+	case <-l.Lost():
+		t.Fatal("lease lost")
+	default:
+	}
+
+	// A waiting Lock gets it once released
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		l.Release(ctx)
+	}()
+	timeout, cancel = context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	l2, err := lk.Lock(timeout, "job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l2.Token() == l.Token() {
+		t.Fatal("token reused")
+	}
+	if err = l.Release(ctx); err != ErrLockNotHeld {
+		t.Fatalf("got %v", err)
+	}
+	if err = l2.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockQuorum(t *testing.T) {
+	var servers []string
+	for i := 0; i < 3; i++ {
+		s, _ := newLockServer()
+		defer s.Close()
+		servers = append(servers, s.Addr())
+	}
+	// One shard down of three still makes a majority
+	servers[2] = "127.0.0.1:1"
+	p := NewRedisPool(servers, DefaultRedisPooledConnFactory, DefaultPoolConfig)
+	defer p.Close()
+	lk := p.Locker(LockOptions{Quorum: true})
+	ctx := context.Background()
+
+	l, err := lk.TryLock(ctx, "job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = lk.TryLock(ctx, "job"); err != ErrNotObtained {
+		t.Fatalf("got %v", err)
+	}
+	if err = l.Extend(ctx, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err = l.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	servers[1] = "127.0.0.1:2"
+	p2 := NewRedisPool(servers, DefaultRedisPooledConnFactory, DefaultPoolConfig)
+	defer p2.Close()
+	if _, err = p2.Locker(LockOptions{Quorum: true}).TryLock(ctx, "job"); err == nil {
+		t.Fatal("locked without a majority")
+	}
+}
+
+func TestLockerTTL(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("TTL shorter than the drift allowed")
+		}
+	}()
+	p := NewRedisPool([]string{"127.0.0.1:1"}, DefaultRedisPooledConnFactory, DefaultPoolConfig)
+	defer p.Close()
+	p.Locker(LockOptions{TTL: time.Nanosecond})
+}
@@ -0,0 +1,384 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ErrTxFailed is returned by Tx when a watched key kept changing after all retries.
+var ErrTxFailed = errors.New("redis: transaction failed, watched keys changed")
+
+// ErrCrossShard is returned by Pipeline and Tx when keys are on different
+// shards of the pool, use keys of one shard per pipeline.
+var ErrCrossShard = errors.New("redis: keys in request are on different shards")
+
+// ErrNotExecuted is the result of a future whose pipeline is not executed yet.
+var ErrNotExecuted = errors.New("redis: pipeline not executed")
+
+// Number of tries of Tx when EXEC is aborted by a changed watched key.
+var TxMaxRetries = 3
+
+// Future is the reply of a queued command, available after Exec.
+type Future struct {
+	name  string
+	args  []interface{}
+	reply interface{}
+	err   error
+}
+
+func (f *Future) Reply() (interface{}, error) {
+	return f.reply, f.err
+}
+
+type StringFuture struct{ *Future }
+
+func (f StringFuture) Result() (string, error) {
+	v, err := redis.String(f.reply, f.err)
+	return v, notFound(err)
+}
+
+type IntFuture struct{ *Future }
+
+func (f IntFuture) Result() (int64, error) {
+	v, err := redis.Int64(f.reply, f.err)
+	return v, notFound(err)
+}
+
+type BoolFuture struct{ *Future }
+
+func (f BoolFuture) Result() (bool, error) {
+	v, err := redis.Bool(f.reply, f.err)
+	return v, notFound(err)
+}
+
+type FloatFuture struct{ *Future }
+
+func (f FloatFuture) Result() (float64, error) {
+	v, err := redis.Float64(f.reply, f.err)
+	return v, notFound(err)
+}
+
+type StringMapFuture struct{ *Future }
+
+func (f StringMapFuture) Result() (map[string]string, error) {
+	return redis.StringMap(f.reply, f.err)
+}
+
+type StatusFuture struct{ *Future }
+
+func (f StatusFuture) Err() error {
+	return f.err
+}
+
+// Pipeline queues commands and sends them in one round trip by Exec.
+// All keys queued must be on one shard, or in one slot in cluster mode.
+type Pipeline struct {
+	c    *Cmd
+	cmds []*Future
+}
+
+func (c *Cmd) Pipeline() *Pipeline {
+	return &Pipeline{c: c}
+}
+
+// Do queues any command.
+func (p *Pipeline) Do(commandName string, args ...interface{}) *Future {
+	f := &Future{name: commandName, args: args, err: ErrNotExecuted}
+	p.cmds = append(p.cmds, f)
+	return f
+}
+
+func (p *Pipeline) Get(key string) StringFuture {
+	return StringFuture{p.Do("GET", key)}
+}
+
+func (p *Pipeline) Set(key string, value interface{}, ttl time.Duration) StatusFuture {
+	if ttl > 0 {
+		return StatusFuture{p.Do("SET", key, value, "PX", ttlMillis(ttl))}
+	}
+	return StatusFuture{p.Do("SET", key, value)}
+}
+
+func (p *Pipeline) Del(keys ...string) IntFuture {
+	return IntFuture{p.Do("DEL", redis.Args{}.AddFlat(keys)...)}
+}
+
+func (p *Pipeline) Incr(key string) IntFuture {
+	return IntFuture{p.Do("INCR", key)}
+}
+
+func (p *Pipeline) IncrBy(key string, n int64) IntFuture {
+	return IntFuture{p.Do("INCRBY", key, n)}
+}
+
+func (p *Pipeline) Expire(key string, ttl time.Duration) BoolFuture {
+	return BoolFuture{p.Do("PEXPIRE", key, ttlMillis(ttl))}
+}
+
+func (p *Pipeline) HGet(key, field string) StringFuture {
+	return StringFuture{p.Do("HGET", key, field)}
+}
+
+func (p *Pipeline) HSet(key, field string, value interface{}) BoolFuture {
+	return BoolFuture{p.Do("HSET", key, field, value)}
+}
+
+func (p *Pipeline) HGetAll(key string) StringMapFuture {
+	return StringMapFuture{p.Do("HGETALL", key)}
+}
+
+func (p *Pipeline) HIncrBy(key, field string, n int64) IntFuture {
+	return IntFuture{p.Do("HINCRBY", key, field, n)}
+}
+
+func (p *Pipeline) RPush(key string, values ...interface{}) IntFuture {
+	return IntFuture{p.Do("RPUSH", redis.Args{key}.Add(values...)...)}
+}
+
+func (p *Pipeline) SAdd(key string, members ...interface{}) IntFuture {
+	return IntFuture{p.Do("SADD", redis.Args{key}.Add(members...)...)}
+}
+
+func (p *Pipeline) ZAdd(key string, members ...Z) IntFuture {
+	args := redis.Args{key}
+	for _, z := range members {
+		args = args.Add(z.Score, z.Member)
+	}
+	return IntFuture{p.Do("ZADD", args...)}
+}
+
+func (p *Pipeline) ZScore(key string, member interface{}) FloatFuture {
+	return FloatFuture{p.Do("ZSCORE", key, member)}
+}
+
+// Len returns the number of queued commands.
+func (p *Pipeline) Len() int {
+	return len(p.cmds)
+}
+
+// Exec sends the queued commands and fills their futures. It returns the
+// first error, including error replies of single commands.
+func (p *Pipeline) Exec(ctx context.Context) error {
+	if len(p.cmds) == 0 {
+		return nil
+	}
+	conn, err := p.c.conn(ctx, p.keys())
+	if err != nil {
+		p.fail(err)
+		return err
+	}
+	defer conn.Close()
+
+	for _, f := range p.cmds {
+		if err = conn.Send(f.name, f.args...); err != nil {
+			p.fail(err)
+			return err
+		}
+	}
+	if err = conn.Flush(); err != nil {
+		p.fail(err)
+		return err
+	}
+	// Read all replies, so that the connection stays in sync
+	var first error
+	for i, f := range p.cmds {
+		f.reply, f.err = conn.Receive()
+		if f.err != nil && first == nil {
+			first = f.err
+		}
+		if conn.Err() != nil {
+			p.fail(conn.Err(), p.cmds[i+1:]...)
+			return conn.Err()
+		}
+	}
+	return first
+}
+
+func (p *Pipeline) keys() (keys []string) {
+	for _, f := range p.cmds {
+		if len(f.args) > 0 {
+			keys = append(keys, keyString(f.args[0]))
+		}
+	}
+	return
+}
+
+// fail sets err to cmds, or to all commands if none given.
+func (p *Pipeline) fail(err error, cmds ...*Future) {
+	if cmds == nil {
+		cmds = p.cmds
+	}
+	for _, f := range cmds {
+		f.reply, f.err = nil, err
+	}
+}
+
+// conn returns a connection to the shard of keys[0], all keys must be on
+// that shard, or in one slot in cluster mode, where redirects are not followed.
+func (c *Cmd) conn(ctx context.Context, keys []string) (redis.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	key := firstKey(keys)
+	if err := c.sameServer(key, keys); err != nil {
+		return nil, err
+	}
+	conn := c.p.GetForKeyContext(ctx, key)
+	if err := conn.Err(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// sameServer returns ErrCrossShard if keys are not on the shard of key,
+// or ErrCrossSlot if they are not in its slot in cluster mode.
+func (c *Cmd) sameServer(key string, keys []string) error {
+	if c.p.cluster != nil {
+		for _, k := range keys {
+			if Slot(k) != Slot(key) {
+				return ErrCrossSlot
+			}
+		}
+		return nil
+	}
+	dp := c.p.pool()
+	if len(dp.Shards()) < 2 {
+		return nil
+	}
+	shard, err := dp.ShardForKey(key)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if s, _ := dp.ShardForKey(k); s != shard {
+			return ErrCrossShard
+		}
+	}
+	return nil
+}
+
+func firstKey(keys []string) string {
+	if len(keys) > 0 {
+		return keys[0]
+	}
+	return ""
+}
+
+// Tx is an optimistic transaction, see Cmd.Tx.
+type Tx struct {
+	conn redis.Conn
+	pipe *Pipeline
+}
+
+// Do sends a command at once on the watched connection, e.t. to read
+// the watched keys.
+func (tx *Tx) Do(commandName string, args ...interface{}) (interface{}, error) {
+	return tx.conn.Do(commandName, args...)
+}
+
+// Pipeline returns the commands to run in MULTI/EXEC when fn returns.
+func (tx *Tx) Pipeline() *Pipeline {
+	return tx.pipe
+}
+
+// Tx watches keys, calls fn and runs the commands queued in tx.Pipeline()
+// by MULTI/EXEC. If a watched key changed before EXEC, fn is called again,
+// up to TxMaxRetries times before ErrTxFailed is returned. The watched and
+// queued keys must be on the shard of the first watched key, or in its slot
+// in cluster mode, else ErrCrossShard or ErrCrossSlot is returned.
+func (c *Cmd) Tx(ctx context.Context, fn func(tx *Tx) error, keys ...string) error {
+	conn, err := c.conn(ctx, keys)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for tries := 0; tries < TxMaxRetries; tries++ {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		ok, err := c.tx(conn, fn, keys)
+		if err != nil || ok {
+			return err
+		}
+	}
+	return ErrTxFailed
+}
+
+// tx runs one try, ok is false if EXEC is aborted.
+func (c *Cmd) tx(conn redis.Conn, fn func(tx *Tx) error, keys []string) (ok bool, err error) {
+	if len(keys) > 0 {
+		if _, err = conn.Do("WATCH", redis.Args{}.AddFlat(keys)...); err != nil {
+			return false, err
+		}
+	}
+	tx := &Tx{conn: conn, pipe: c.Pipeline()}
+	if err = fn(tx); err != nil {
+		conn.Do("UNWATCH")
+		return false, err
+	}
+	if err = c.sameServer(firstKey(keys), tx.pipe.keys()); err != nil {
+		conn.Do("UNWATCH")
+		tx.pipe.fail(err)
+		return false, err
+	}
+	cmds := tx.pipe.cmds
+	if len(cmds) == 0 {
+		_, err = conn.Do("UNWATCH")
+		return err == nil, err
+	}
+
+	conn.Send("MULTI")
+	for _, f := range cmds {
+		conn.Send(f.name, f.args...)
+	}
+	if err = conn.Flush(); err != nil {
+		tx.pipe.fail(err)
+		return false, err
+	}
+	// Replies of MULTI and QUEUED, errors here also abort EXEC
+	var queueErr error
+	for i := 0; i <= len(cmds); i++ {
+		if _, err = conn.Receive(); err != nil {
+			if conn.Err() != nil {
+				tx.pipe.fail(err)
+				return false, err
+			}
+			if queueErr == nil {
+				queueErr = err
+			}
+		}
+	}
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err == redis.ErrNil {
+		// Watched keys changed
+		return false, nil
+	}
+	if err != nil {
+		if queueErr != nil {
+			err = queueErr
+		}
+		tx.pipe.fail(err)
+		return false, err
+	}
+	var first error
+	for i, f := range cmds {
+		f.reply, f.err = nil, ErrNotExecuted
+		if i < len(replies) {
+			f.reply = replies[i]
+			if rerr, isErr := replies[i].(redis.Error); isErr {
+				f.reply, f.err = nil, rerr
+				if first == nil {
+					first = rerr
+				}
+			} else {
+				f.err = nil
+			}
+		}
+	}
+	return true, first
+}
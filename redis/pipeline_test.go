@@ -0,0 +1,135 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/feekk/zddgo/redis/redistest"
+)
+
+func TestPipelineAndTx(t *testing.T) {
+	s := redistest.NewServer()
+	defer s.Close()
+	p := NewRedisPool([]string{s.Addr()}, DefaultRedisPooledConnFactory, DefaultPoolConfig)
+	defer p.Close()
+	cmd := p.Cmd()
+	ctx := context.Background()
+
+	pipe := cmd.Pipeline()
+	set := pipe.Set("a", "x", 0)
+	get := pipe.Get("a")
+	incr := pipe.Incr("a")
+	missing := pipe.Get("missing")
+	if err := pipe.Exec(ctx); err == nil {
+		t.Error("expected error of INCR")
+	}
+	if set.Err() != nil {
+		t.Error(set.Err())
+	}
+	if v, err := get.Result(); err != nil || v != "x" {
+		t.Errorf("GET = %q, %v", v, err)
+	}
+	if _, err := incr.Result(); err == nil {
+		t.Error("INCR should fail")
+	}
+	if _, err := missing.Result(); err != ErrNotFound {
+		t.Errorf("expected not found, got %v", err)
+	}
+
+	s.Set("counter", "9")
+	calls := 0
+	var res StatusFuture
+	err := cmd.Tx(ctx, func(tx *Tx) error {
+		calls++
+		n, err := redisInt(tx.Do("GET", "counter"))
+		if err != nil {
+			return err
+		}
+		if calls == 1 {
+			// Changed by another client after WATCH
+			s.Set("counter", "10")
+		}
+		res = tx.Pipeline().Set("counter", n+1, 0)
+		return nil
+	}, "counter")
+	counter, _ := s.Get("counter")
+	if err != nil || calls != 2 || res.Err() != nil || counter != "11" {
+		t.Errorf("tx err=%v calls=%d res=%v", err, calls, res.Err())
+	}
+
+	if err = cmd.Tx(ctx, func(tx *Tx) error {
+		s.Set("counter", "12")
+		tx.Pipeline().Set("counter", 0, 0)
+		return nil
+	}, "counter"); err != ErrTxFailed {
+		t.Errorf("expected tx failed, got %v", err)
+	}
+
+	stats := p.GetPoolStats()
+	if stats[0].NumActive != 1 || stats[0].NumBroken != 0 || stats[0].NumGet != stats[0].NumPut {
+		t.Errorf("connection not returned %+v", stats[0])
+	}
+}
+
+func redisInt(reply interface{}, err error) (int, error) {
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(reply.([]byte)))
+}
+
+func TestPipelineShards(t *testing.T) {
+	a, b := redistest.NewServer(), redistest.NewServer()
+	defer a.Close()
+	defer b.Close()
+	p := NewRedisPool([]string{a.Addr(), b.Addr()}, DefaultRedisPooledConnFactory, DefaultPoolConfig)
+	defer p.Close()
+	cmd := p.Cmd()
+	ctx := context.Background()
+
+	// Keys of each shard
+	byShard := map[*PoolShard][]string{}
+	for i := 0; i < 20; i++ {
+		key := "k" + strconv.Itoa(i)
+		shard, _ := p.pool().ShardForKey(key)
+		byShard[shard] = append(byShard[shard], key)
+	}
+	if len(byShard) != 2 {
+		t.Fatal("keys not spread")
+	}
+
+	pipe := cmd.Pipeline()
+	for i := 0; i < 20; i++ {
+		pipe.Set("k"+strconv.Itoa(i), i, 0)
+	}
+	if err := pipe.Exec(ctx); err != ErrCrossShard {
+		t.Errorf("expected cross shard, got %v", err)
+	}
+	for _, keys := range byShard {
+		pipe = cmd.Pipeline()
+		for _, key := range keys {
+			pipe.Set(key, key, 0)
+		}
+		if err := pipe.Exec(ctx); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range keys {
+			if v, err := cmd.Get(ctx, key); err != nil || v != key {
+				t.Errorf("get %s = %q, %v", key, v, err)
+			}
+		}
+	}
+
+	var keys []string
+	for _, ks := range byShard {
+		keys = append(keys, ks[0])
+	}
+	err := cmd.Tx(ctx, func(tx *Tx) error {
+		tx.Pipeline().Set(keys[1], "v", 0)
+		return nil
+	}, keys[0])
+	if err != ErrCrossShard {
+		t.Errorf("expected cross shard, got %v", err)
+	}
+}
@@ -0,0 +1,375 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ErrSubscriberClosed is returned by the methods of a closed Subscriber.
+var ErrSubscriberClosed error = errors.New("pubsub: subscriber closed")
+
+type SubscriberConfig struct {
+	// Interval of PING on the idle subscription, the connection is considered
+	// broken if nothing is received in two intervals. 30 seconds by default
+	PingInterval time.Duration
+	// Wait between reconnects, doubled after each failure up to MaxBackoff.
+	// 100ms and 5 seconds by default
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Buffer size of the Messages channel, 100 by default
+	BufferSize int
+}
+
+// Message is a message received by a Subscriber.
+type Message struct {
+	// Pattern matched by PSUBSCRIBE, empty for SUBSCRIBE
+	Pattern string
+	Channel string
+	Data    []byte
+}
+
+// MessageHandler handles the messages of a channel or a pattern.
+type MessageHandler func(msg Message)
+
+// Subscriber keeps a dedicated connection for SUBSCRIBE and PSUBSCRIBE out of
+// the pool, it reconnects and subscribes again after disconnects.
+// Messages published meanwhile are lost, as Redis does not keep them.
+type Subscriber struct {
+	conf        SubscriberConfig
+	connFactory PooledConnFactory
+	// Address to dial, called on every reconnect
+	addr func() string
+
+	// Guards channels, patterns, conn and writes on conn. Receive is only
+	// called by the run goroutine, redigo allows it concurrently with Send.
+	mu       sync.Mutex
+	channels map[string]MessageHandler
+	patterns map[string]MessageHandler
+	conn     redis.Conn
+	closed   bool
+
+	messages chan Message
+	stopper  chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewSubscriber creates a Subscriber dialing the address returned by addr
+// with connFactory, which must create *RedisPooledConnection.
+func NewSubscriber(addr func() string, connFactory PooledConnFactory, conf SubscriberConfig) *Subscriber {
+	if addr == nil || connFactory == nil {
+		panic("Illegal Arguments")
+	}
+	if conf.PingInterval <= 0 {
+		conf.PingInterval = 30 * time.Second
+	}
+	if conf.MinBackoff <= 0 {
+		conf.MinBackoff = 100 * time.Millisecond
+	}
+	if conf.MaxBackoff < conf.MinBackoff {
+		conf.MaxBackoff = 5 * time.Second
+		if conf.MaxBackoff < conf.MinBackoff {
+			conf.MaxBackoff = conf.MinBackoff
+		}
+	}
+	if conf.BufferSize <= 0 {
+		conf.BufferSize = 100
+	}
+	s := &Subscriber{
+		conf:        conf,
+		connFactory: connFactory,
+		addr:        addr,
+		channels:    make(map[string]MessageHandler),
+		patterns:    make(map[string]MessageHandler),
+		messages:    make(chan Message, conf.BufferSize),
+		stopper:     make(chan struct{}),
+	}
+	s.wg.Add(2)
+	go s.goRun()
+	go s.goPing()
+	return s
+}
+
+// NewSubscriber creates a Subscriber on the server of the pool, the current
+// master in sentinel mode or any master in cluster mode, where PUBLISH is
+// broadcast to all nodes. With several shards, the first available server is
+// used, so messages must be published on the same server, see Publish.
+func (p *RedisPool) NewSubscriber(conf SubscriberConfig) *Subscriber {
+	switch {
+	case p.sentinel != nil:
+		return NewSubscriber(p.sentinel.MasterAddr, p.sentinel.connFactory, conf)
+	case p.cluster != nil:
+		return NewSubscriber(func() string { return p.cluster.slotAddr(-1) }, p.cluster.connFactory, conf)
+	}
+	dp := p.dp
+	return NewSubscriber(func() string {
+		return pubsubShard(dp).Server()
+	}, dp.ConnFactory(), conf)
+}
+
+// pubsubShard returns the first available shard, which serves pub/sub with several shards.
+func pubsubShard(dp *Pool) *PoolShard {
+	shards := dp.Shards()
+	for _, shard := range shards {
+		if shard.Available() {
+			return shard
+		}
+	}
+	return shards[0]
+}
+
+// Publish publishes message on channel on the server the subscribers of
+// NewSubscriber are on, and returns the number of receivers.
+func (p *RedisPool) Publish(ctx context.Context, channel string, message interface{}) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	var conn redis.Conn
+	if p.dp != nil {
+		raw, err := pubsubShard(p.dp).Get(ctx)
+		if err != nil {
+			return 0, err
+		}
+		conn = borrowed(raw, p.dp, ctx)
+	} else {
+		conn = p.GetContext(ctx)
+	}
+	defer conn.Close()
+	return redis.Int64(conn.Do("PUBLISH", channel, message))
+}
+
+// Messages returns the channel of the messages without a handler, it is
+// closed by Close. The connection is not read while the channel is full.
+func (s *Subscriber) Messages() <-chan Message {
+	return s.messages
+}
+
+// Subscribe subscribes channels, the messages are sent to Messages.
+func (s *Subscriber) Subscribe(channels ...string) error {
+	return s.subscribe(s.channels, "SUBSCRIBE", nil, channels)
+}
+
+// SubscribeFunc subscribes channel, the messages are handled by h on the
+// receiving goroutine, so h should not block.
+func (s *Subscriber) SubscribeFunc(channel string, h MessageHandler) error {
+	return s.subscribe(s.channels, "SUBSCRIBE", h, []string{channel})
+}
+
+// PSubscribe subscribes patterns, the messages are sent to Messages.
+func (s *Subscriber) PSubscribe(patterns ...string) error {
+	return s.subscribe(s.patterns, "PSUBSCRIBE", nil, patterns)
+}
+
+// PSubscribeFunc is like SubscribeFunc for a pattern.
+func (s *Subscriber) PSubscribeFunc(pattern string, h MessageHandler) error {
+	return s.subscribe(s.patterns, "PSUBSCRIBE", h, []string{pattern})
+}
+
+// Unsubscribe unsubscribes channels.
+func (s *Subscriber) Unsubscribe(channels ...string) error {
+	return s.unsubscribe(s.channels, "UNSUBSCRIBE", channels)
+}
+
+// PUnsubscribe unsubscribes patterns.
+func (s *Subscriber) PUnsubscribe(patterns ...string) error {
+	return s.unsubscribe(s.patterns, "PUNSUBSCRIBE", patterns)
+}
+
+// subscribe records names to subscribe again after reconnects. A write error
+// is not returned, since the broken connection is reconnected by the run goroutine.
+func (s *Subscriber) subscribe(subs map[string]MessageHandler, commandName string, h MessageHandler, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrSubscriberClosed
+	}
+	for _, name := range names {
+		subs[name] = h
+	}
+	if s.conn != nil {
+		s.send(commandName, names)
+	}
+	return nil
+}
+
+func (s *Subscriber) unsubscribe(subs map[string]MessageHandler, commandName string, names []string) error {
+	if len(names) == 0 {
+		// UNSUBSCRIBE without arguments would drop all of them
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrSubscriberClosed
+	}
+	for _, name := range names {
+		delete(subs, name)
+	}
+	if s.conn != nil {
+		s.send(commandName, names)
+	}
+	return nil
+}
+
+// send writes a command on conn with s.mu held.
+func (s *Subscriber) send(commandName string, names []string) error {
+	args := make([]interface{}, len(names))
+	for i, name := range names {
+		args[i] = name
+	}
+	s.conn.Send(commandName, args...)
+	return s.conn.Flush()
+}
+
+// goRun receives on the connection, reconnecting with backoff until closed.
+func (s *Subscriber) goRun() {
+	defer s.wg.Done()
+	defer close(s.messages)
+
+	backoff := s.conf.MinBackoff
+	for {
+		if s.run() {
+			backoff = s.conf.MinBackoff
+		}
+		select {
+		case <-s.stopper:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > s.conf.MaxBackoff {
+			backoff = s.conf.MaxBackoff
+		}
+	}
+}
+
+// run dials, subscribes again and receives until the connection is broken,
+// it returns whether the server confirmed a subscription or answered a ping,
+// so that a server dropping every connection is still redialed with backoff.
+func (s *Subscriber) run() bool {
+	addr := s.addr()
+	if addr == "" {
+		return false
+	}
+	raw, err := s.connFactory.Create(addr)
+	if err != nil {
+		return false
+	}
+	pc, ok := raw.(*RedisPooledConnection)
+	if !ok {
+		s.connFactory.Close(raw)
+		return false
+	}
+	c := pc.c
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		c.Close()
+		return false
+	}
+	s.conn = c
+	if len(s.channels) > 0 {
+		err = s.send("SUBSCRIBE", names(s.channels))
+	}
+	if err == nil && len(s.patterns) > 0 {
+		err = s.send("PSUBSCRIBE", names(s.patterns))
+	}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.conn = nil
+		s.mu.Unlock()
+		c.Close()
+	}()
+	if err != nil {
+		return false
+	}
+
+	psc := redis.PubSubConn{Conn: c}
+	confirmed := false
+	for {
+		switch v := psc.ReceiveWithTimeout(2 * s.conf.PingInterval).(type) {
+		case redis.Subscription, redis.Pong:
+			confirmed = true
+		case redis.Message:
+			s.dispatch(Message{Channel: v.Channel, Data: v.Data})
+		case redis.PMessage:
+			s.dispatch(Message{Pattern: v.Pattern, Channel: v.Channel, Data: v.Data})
+		case error:
+			return confirmed
+		}
+	}
+}
+
+// dispatch calls the handler of the message, or sends it to Messages.
+func (s *Subscriber) dispatch(msg Message) {
+	s.mu.Lock()
+	var h MessageHandler
+	if msg.Pattern != "" {
+		h = s.patterns[msg.Pattern]
+	} else {
+		h = s.channels[msg.Channel]
+	}
+	s.mu.Unlock()
+
+	if h != nil {
+		h(msg)
+		return
+	}
+	select {
+	case s.messages <- msg:
+	case <-s.stopper:
+	}
+}
+
+// goPing keeps the subscription alive, the PONG replies are dropped by run.
+func (s *Subscriber) goPing() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.conf.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopper:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			if s.conn != nil {
+				s.conn.Send("PING")
+				s.conn.Flush()
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// Close closes the connection and waits for the goroutines to stop.
+func (s *Subscriber) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrSubscriberClosed
+	}
+	s.closed = true
+	close(s.stopper)
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+func names(subs map[string]MessageHandler) []string {
+	l := make([]string, 0, len(subs))
+	for name := range subs {
+		l = append(l, name)
+	}
+	return l
+}
@@ -0,0 +1,96 @@
+package redis
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/feekk/zddgo/redis/redistest"
+)
+
+func TestSubscriberReconnect(t *testing.T) {
+	s := redistest.NewServer()
+	defer s.Close()
+	publish := func() int {
+		return s.Publish("news", "hello") + s.Publish("user.1", "login")
+	}
+	waitPublish := func(want int) {
+		deadline := time.Now().Add(2 * time.Second)
+		for publish() < want {
+			if time.Now().After(deadline) {
+				t.Fatal("not subscribed")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	p := NewRedisPool([]string{s.Addr()}, DefaultRedisPooledConnFactory, DefaultPoolConfig)
+	defer p.Close()
+	sub := p.NewSubscriber(SubscriberConfig{MinBackoff: 10 * time.Millisecond})
+	handled := make(chan Message, 10)
+	if err := sub.Subscribe("news"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sub.PSubscribeFunc("user.*", func(msg Message) { handled <- msg }); err != nil {
+		t.Fatal(err)
+	}
+
+	waitPublish(2)
+	if msg := <-sub.Messages(); msg.Channel != "news" || string(msg.Data) != "hello" {
+		t.Fatalf("got %+v", msg)
+	}
+	if msg := <-handled; msg.Pattern != "user.*" || msg.Channel != "user.1" {
+		t.Fatalf("got %+v", msg)
+	}
+
+	// Drop the connection, the subscriber subscribes again on a new one
+	s.DropConnections()
+	waitPublish(2)
+	if msg := <-sub.Messages(); msg.Channel != "news" {
+		t.Fatalf("got %+v", msg)
+	}
+	<-handled
+
+	if err := sub.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-sub.Messages(); ok {
+		t.Fatal("messages not closed")
+	}
+	if err := sub.Subscribe("other"); err != ErrSubscriberClosed {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestSubscriberBackoff(t *testing.T) {
+	// A server accepting connections and dropping them at once
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var dials int32
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&dials, 1)
+			c.Close()
+		}
+	}()
+
+	sub := NewSubscriber(func() string { return l.Addr().String() }, DefaultRedisPooledConnFactory,
+		SubscriberConfig{MinBackoff: 20 * time.Millisecond, MaxBackoff: time.Second})
+	defer sub.Close()
+	if err := sub.Subscribe("news"); err != nil {
+		t.Fatal(err)
+	}
+	// 20, 40, 80 and 160ms, not every 20ms
+	time.Sleep(400 * time.Millisecond)
+	if n := atomic.LoadInt32(&dials); n == 0 || n > 6 {
+		t.Errorf("dialed %d times", n)
+	}
+}
@@ -1,6 +1,10 @@
 package redis
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"strings"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
@@ -12,13 +16,55 @@ type RedisPooledConnection struct {
 	addr string
 	c    redis.Conn
 	dp   *Pool
+	// Database selected on dial, restored on Close if the application
+	// sent SELECT on this connection.
+	db        int
+	dbChanged bool
+	// Context the connection is borrowed with, passed to observer
+	ctx      context.Context
+	name     string
+	observer CommandObserver
+	slow     time.Duration
 }
 
+// CommandInfo describes a command sent by RedisPooledConnection.Do.
+type CommandInfo struct {
+	// Pool name, see RedisPooledConnFactory.Name
+	Pool string
+	// Server address
+	Shard   string
+	Command string
+	// First argument of the command, which is the key of most commands
+	Key      string
+	Duration time.Duration
+	Err      error
+	// Duration exceeds RedisPooledConnFactory.SlowThreshold
+	Slow bool
+}
+
+// CommandObserver is called after every command, ctx is the context the
+// connection is borrowed with, e.g. by GetContext, or context.Background.
+type CommandObserver func(ctx context.Context, info *CommandInfo)
+
 type RedisPooledConnFactory struct {
-	Password       string
+	// Username for ACL style AUTH, only Password is sent if empty
+	Username string
+	Password string
+	Db       int
+	// Sent by CLIENT SETNAME if not empty
+	ClientName string
+	UseTLS     bool
+	// Optional TLS config, server name defaults to the host of the address
+	TLSConfig      *tls.Config
 	ConnectTimeout time.Duration
 	ReadTimeout    time.Duration
 	WriteTimeout   time.Duration
+	// Pool name reported to Observer
+	Name string
+	// Optional, instruments the commands sent by Do
+	Observer CommandObserver
+	// Commands slower than this are reported as slow, zero disables it
+	SlowThreshold time.Duration
 }
 
 var DefaultRedisPooledConnFactory RedisPooledConnFactory = RedisPooledConnFactory{
@@ -29,26 +75,61 @@ var DefaultRedisPooledConnFactory RedisPooledConnFactory = RedisPooledConnFactor
 
 // Factory to create new connection
 func (f RedisPooledConnFactory) Create(address string) (pc Poolable, err error) {
-	c, err := redis.DialTimeout("tcp", address, f.ConnectTimeout, f.ReadTimeout, f.WriteTimeout)
+	c, err := redis.Dial("tcp", address,
+		redis.DialConnectTimeout(f.ConnectTimeout),
+		redis.DialReadTimeout(f.ReadTimeout),
+		redis.DialWriteTimeout(f.WriteTimeout),
+		redis.DialUseTLS(f.UseTLS),
+		redis.DialTLSConfig(f.TLSConfig),
+	)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(f.Password) > 0 {
-		if _, err = c.Do("AUTH", f.Password); err != nil {
-			c.Close()
-			return nil, err
-		}
+	if err = f.setup(c); err != nil {
+		c.Close()
+		return nil, err
 	}
 
 	pc = &RedisPooledConnection{
 		PooledObject: &PooledObject{},
 		c:            c,
 		addr:         address,
+		db:           f.Db,
+		name:         f.Name,
+		observer:     f.Observer,
+		slow:         f.SlowThreshold,
 	}
 	return pc, nil
 }
 
+// setup authenticates, selects the database and names the connection.
+func (f RedisPooledConnFactory) setup(c redis.Conn) (err error) {
+	if len(f.Username) > 0 {
+		_, err = c.Do("AUTH", f.Username, f.Password)
+	} else if len(f.Password) > 0 {
+		_, err = c.Do("AUTH", f.Password)
+	}
+	if err != nil {
+		return err
+	}
+
+	if f.Db != 0 {
+		if _, err = c.Do("SELECT", f.Db); err != nil {
+			return err
+		}
+	}
+
+	if len(f.ClientName) > 0 {
+		// Client name can not contain spaces
+		name := strings.Replace(f.ClientName, " ", "-", -1)
+		if _, err = c.Do("CLIENT", "SETNAME", name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (f RedisPooledConnFactory) Validate(pc Poolable) (err error) {
 	_, err = pc.(*RedisPooledConnection).Do("PING")
 	return err
@@ -61,10 +142,17 @@ func (f RedisPooledConnFactory) Close(pc Poolable) error {
 // Close closes the connection.
 // @Override
 func (pc *RedisPooledConnection) Close() error {
-	err := pc.c.Err()
 	if pc.dp == nil {
 		return pc.c.Close()
 	}
+	pc.ctx = nil
+	if pc.dbChanged && pc.c.Err() == nil {
+		pc.dbChanged = false
+		if _, err := pc.c.Do("SELECT", pc.db); err != nil {
+			return pc.dp.Put(pc, true)
+		}
+	}
+	err := pc.c.Err()
 	if err != nil && err != redis.ErrNil {
 		return pc.dp.Put(pc, true)
 	} else {
@@ -84,15 +172,50 @@ func (pc *RedisPooledConnection) Err() error {
 // Do sends a command to the server and returns the received reply.
 // @Override
 func (pc *RedisPooledConnection) Do(commandName string, args ...interface{}) (reply interface{}, err error) {
-	return pc.c.Do(commandName, args...)
+	pc.trackSelect(commandName)
+	if pc.observer == nil || commandName == "" {
+		return pc.c.Do(commandName, args...)
+	}
+	start := time.Now()
+	reply, err = pc.c.Do(commandName, args...)
+	pc.observe(start, commandName, args, err)
+	return
+}
+
+// observe reports a command to the observer.
+func (pc *RedisPooledConnection) observe(start time.Time, commandName string, args []interface{}, err error) {
+	info := &CommandInfo{
+		Pool:     pc.name,
+		Shard:    pc.addr,
+		Command:  strings.ToUpper(commandName),
+		Duration: time.Since(start),
+		Err:      err,
+	}
+	if len(args) > 0 {
+		info.Key = keyString(args[0])
+	}
+	info.Slow = pc.slow > 0 && info.Duration >= pc.slow
+	ctx := pc.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	pc.observer(ctx, info)
 }
 
 // Send writes the command to the client's output buffer.
 // @Override
 func (pc *RedisPooledConnection) Send(commandName string, args ...interface{}) error {
+	pc.trackSelect(commandName)
 	return pc.c.Send(commandName, args...)
 }
 
+// trackSelect remembers that the database may differ from the configured one.
+func (pc *RedisPooledConnection) trackSelect(commandName string) {
+	if strings.EqualFold(commandName, "SELECT") {
+		pc.dbChanged = true
+	}
+}
+
 // Flush flushes the output buffer to the Redis server.
 // @Override
 func (pc *RedisPooledConnection) Flush() error {
@@ -105,6 +228,26 @@ func (pc *RedisPooledConnection) Receive() (reply interface{}, err error) {
 	return pc.c.Receive()
 }
 
+// DoWithTimeout is like Do with a read timeout other than the dial one,
+// e.g. for blocking commands.
+// @Override
+func (pc *RedisPooledConnection) DoWithTimeout(timeout time.Duration, commandName string, args ...interface{}) (reply interface{}, err error) {
+	pc.trackSelect(commandName)
+	if pc.observer == nil || commandName == "" {
+		return redis.DoWithTimeout(pc.c, timeout, commandName, args...)
+	}
+	start := time.Now()
+	reply, err = redis.DoWithTimeout(pc.c, timeout, commandName, args...)
+	pc.observe(start, commandName, args, err)
+	return
+}
+
+// ReceiveWithTimeout is like Receive with a read timeout other than the dial one.
+// @Override
+func (pc *RedisPooledConnection) ReceiveWithTimeout(timeout time.Duration) (reply interface{}, err error) {
+	return redis.ReceiveWithTimeout(pc.c, timeout)
+}
+
 // 用于兼容redigo接口拷贝自redigo代码
 type errorConnection struct{ err error }
 
@@ -114,33 +257,183 @@ func (ec errorConnection) Err() error                                     { retu
 func (ec errorConnection) Close() error                                   { return ec.err }
 func (ec errorConnection) Flush() error                                   { return ec.err }
 func (ec errorConnection) Receive() (interface{}, error)                  { return nil, ec.err }
+func (ec errorConnection) DoWithTimeout(time.Duration, string, ...interface{}) (interface{}, error) {
+	return nil, ec.err
+}
+func (ec errorConnection) ReceiveWithTimeout(time.Duration) (interface{}, error) { return nil, ec.err }
 
 type RedisPool struct {
 	dp *Pool
+	// Set in sentinel mode, which owns the pools of the master and replicas
+	sentinel *Sentinel
+	// Set in cluster mode, which owns a pool per master node
+	cluster *Cluster
+	// Scripts loaded on every shard, see LoadScripts
+	scripts *scriptSet
 }
 
 func NewRedisPool(servers []string, connFactory PooledConnFactory, poolConfig PoolConfig) *RedisPool {
-	return &RedisPool{dp: NewPool(servers, connFactory, poolConfig)}
+	scripts := newScriptSet(connFactory)
+	poolConfig = scripts.hook(poolConfig)
+	return &RedisPool{dp: NewPool(servers, connFactory, poolConfig), scripts: scripts}
 }
 
 // 兼容redigo pool的Get()接口
 func (p *RedisPool) Get() redis.Conn {
-	raw, err := p.dp.Get()
+	return p.GetContext(context.Background())
+}
+
+// GetContext is like Get, ctx bounds the time waiting for an exhausted shard
+// when PoolConfig.Wait is set.
+func (p *RedisPool) GetContext(ctx context.Context) redis.Conn {
+	if p.cluster != nil {
+		// Keyless commands are spread over the masters
+		pc, err := p.cluster.conn(ctx, p.cluster.slotAddr(-1))
+		if err != nil {
+			return errorConnection{err}
+		}
+		return pc
+	}
+	return p.get(p.pool(), ctx)
+}
+
+// GetReplica returns a connection to a replica for read-only commands in
+// sentinel mode with ReadFromReplicas, or to the master otherwise.
+func (p *RedisPool) GetReplica() redis.Conn {
+	return p.GetReplicaContext(context.Background())
+}
+
+func (p *RedisPool) GetReplicaContext(ctx context.Context) redis.Conn {
+	if p.sentinel != nil {
+		if dp := p.sentinel.replicaPool(); dp != nil {
+			if c := p.get(dp, ctx); c.Err() == nil {
+				return c
+			}
+		}
+	}
+	return p.GetContext(ctx)
+}
+
+// Cluster returns the cluster in cluster mode, or nil.
+func (p *RedisPool) Cluster() *Cluster {
+	return p.cluster
+}
+
+// Sentinel returns the sentinel in sentinel mode, or nil.
+func (p *RedisPool) Sentinel() *Sentinel {
+	return p.sentinel
+}
+
+// pools returns all pools, the master and replicas ones in sentinel mode or
+// the node ones in cluster mode.
+func (p *RedisPool) pools() (pools []*Pool) {
+	switch {
+	case p.sentinel != nil:
+		pools = append(pools, p.sentinel.masterPool())
+		if dp := p.sentinel.replicaPool(); dp != nil {
+			pools = append(pools, dp)
+		}
+	case p.cluster != nil:
+		p.cluster.mu.RLock()
+		for _, dp := range p.cluster.nodes {
+			pools = append(pools, dp)
+		}
+		p.cluster.mu.RUnlock()
+	default:
+		pools = append(pools, p.dp)
+	}
+	return
+}
+
+// pool returns the current pool, which changes on failover in sentinel mode.
+func (p *RedisPool) pool() *Pool {
+	if p.sentinel != nil {
+		return p.sentinel.masterPool()
+	}
+	return p.dp
+}
+
+func (p *RedisPool) get(dp *Pool, ctx context.Context) redis.Conn {
+	raw, err := dp.GetContext(ctx)
 	if err != nil {
 		return errorConnection{err}
 	}
 
+	return borrowed(raw, dp, ctx)
+}
+
+// borrowed binds a connection got from dp to it, and to ctx for the observer.
+func borrowed(raw Poolable, dp *Pool, ctx context.Context) *RedisPooledConnection {
 	pc := raw.(*RedisPooledConnection)
-	pc.dp = p.dp
+	pc.dp = dp
+	pc.ctx = ctx
 	return pc
 }
 
+// GetForKey returns a connection to the shard owning key, so that keys can be
+// partitioned across servers. In cluster mode it is the master of the slot of key.
+func (p *RedisPool) GetForKey(key string) redis.Conn {
+	return p.GetForKeyContext(context.Background(), key)
+}
+
+func (p *RedisPool) GetForKeyContext(ctx context.Context, key string) redis.Conn {
+	if p.cluster != nil {
+		return p.cluster.Get(ctx, key)
+	}
+	dp := p.pool()
+	raw, err := dp.GetForKey(ctx, key)
+	if err != nil {
+		return errorConnection{err}
+	}
+	return borrowed(raw, dp, ctx)
+}
+
+// ErrServersManaged is returned when changing the servers of a pool in
+// sentinel or cluster mode, which follow the topology by themselves.
+var ErrServersManaged error = errors.New("redis: servers are managed by sentinel or cluster")
+
+// AddServer adds a shard at runtime, see Pool.AddServer.
+func (p *RedisPool) AddServer(server string, weight int) error {
+	if p.dp == nil {
+		return ErrServersManaged
+	}
+	return p.dp.AddServer(server, weight)
+}
+
+// RemoveServer drains and removes a shard at runtime, see Pool.RemoveServer.
+func (p *RedisPool) RemoveServer(server string) error {
+	if p.dp == nil {
+		return ErrServersManaged
+	}
+	return p.dp.RemoveServer(server)
+}
+
+// ReplaceServers replaces the shards at runtime, e.g. on config reload or
+// service discovery, see Pool.ReplaceServers.
+func (p *RedisPool) ReplaceServers(servers []string, weights []int) error {
+	if p.dp == nil {
+		return ErrServersManaged
+	}
+	return p.dp.ReplaceServers(servers, weights)
+}
+
 // 兼容redigo的关闭函数接口
 func (p *RedisPool) Close() (err error) {
+	if p.sentinel != nil {
+		p.sentinel.Close()
+		return
+	}
+	if p.cluster != nil {
+		p.cluster.Close()
+		return
+	}
 	p.dp.Shutdown()
 	return
 }
 
 func (p *RedisPool) GetPoolStats() (stats []PoolStats) {
-	return p.dp.GetPoolStats()
+	if p.cluster != nil {
+		return p.cluster.GetPoolStats()
+	}
+	return p.pool().GetPoolStats()
 }
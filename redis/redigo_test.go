@@ -0,0 +1,84 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// recordConn is a redis.Conn recording the commands sent.
+type recordConn struct {
+	cmds []string
+	err  error
+}
+
+func (c *recordConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	c.cmds = append(c.cmds, cmd)
+	return "OK", nil
+}
+func (c *recordConn) Send(cmd string, args ...interface{}) error {
+	c.cmds = append(c.cmds, cmd)
+	return nil
+}
+func (c *recordConn) Err() error                    { return c.err }
+func (c *recordConn) Close() error                  { return nil }
+func (c *recordConn) Flush() error                  { return nil }
+func (c *recordConn) Receive() (interface{}, error) { return nil, nil }
+
+// testFactory creates connections on recordConn without dialing.
+type testFactory struct{}
+
+func (f *testFactory) Create(addr string) (Poolable, error) {
+	return &RedisPooledConnection{PooledObject: &PooledObject{}, c: &recordConn{}, addr: addr}, nil
+}
+
+func (f *testFactory) Validate(c Poolable) error { return nil }
+
+func (f *testFactory) Close(c Poolable) error { return nil }
+
+func TestRedisPooledConnectionRestoreDb(t *testing.T) {
+	dp := NewPool([]string{"a"}, &testFactory{}, DefaultPoolConfig)
+	defer dp.Shutdown()
+
+	p := &RedisPool{dp: dp}
+	pc := p.Get().(*RedisPooledConnection)
+	pc.db = 2
+	rc := pc.c.(*recordConn)
+
+	pc.Do("GET", "k")
+	pc.Close()
+	if len(rc.cmds) != 1 {
+		t.Errorf("unexpected commands %v", rc.cmds)
+	}
+
+	if p.Get() != pc {
+		t.Fatal("idle connection not reused")
+	}
+	pc.Do("select", 5)
+	pc.Close()
+	if len(rc.cmds) != 3 || rc.cmds[2] != "SELECT" {
+		t.Errorf("database not restored %v", rc.cmds)
+	}
+}
+
+func TestRedisPooledConnectionObserver(t *testing.T) {
+	type ctxKey struct{}
+	var infos []*CommandInfo
+	var values []interface{}
+	pc := &RedisPooledConnection{PooledObject: &PooledObject{}, c: &recordConn{}, addr: "a", name: "default"}
+	pc.slow = time.Nanosecond
+	pc.observer = func(ctx context.Context, info *CommandInfo) {
+		infos = append(infos, info)
+		values = append(values, ctx.Value(ctxKey{}))
+	}
+
+	pc.Do("PING")
+	pc.ctx = context.WithValue(context.Background(), ctxKey{}, "trace")
+	pc.Do("get", "k")
+	if len(infos) != 2 || values[0] != nil || values[1] != "trace" {
+		t.Fatalf("got %v %v", infos, values)
+	}
+	if i := infos[1]; i.Pool != "default" || i.Shard != "a" || i.Command != "GET" || i.Key != "k" || !i.Slow {
+		t.Errorf("got %+v", i)
+	}
+}
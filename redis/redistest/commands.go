@@ -0,0 +1,1286 @@
+package redistest
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	errWrongType = "WRONGTYPE Operation against a key holding the wrong kind of value"
+	errNotInt    = "ERR value is not an integer or out of range"
+	errNotFloat  = "ERR value is not a valid float"
+	errSyntax    = "ERR syntax error"
+	errNoKey     = "ERR no such key"
+)
+
+// handler runs a command on args without the command name, with Server.mu held.
+type handler func(s *Server, c *conn, args []string, w *reply, out *outbox)
+
+type command struct {
+	// Number of arguments including the name as in the Redis command table,
+	// negative for at least -arity
+	arity int
+	f     handler
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		// connection
+		"ping":   {-1, cmdPing},
+		"echo":   {2, cmdEcho},
+		"auth":   {-2, cmdAuth},
+		"select": {2, cmdSelect},
+		"client": {-2, cmdClient},
+		"quit":   {1, nil},
+
+		// server
+		"flushdb":  {1, cmdFlushDB},
+		"flushall": {1, cmdFlushAll},
+		"dbsize":   {1, cmdDBSize},
+
+		// keys
+		"del":     {-2, cmdDel},
+		"unlink":  {-2, cmdDel},
+		"exists":  {-2, cmdExists},
+		"type":    {2, cmdType},
+		"keys":    {2, cmdKeys},
+		"scan":    {-2, cmdScan},
+		"expire":  {3, cmdExpire(time.Second)},
+		"pexpire": {3, cmdExpire(time.Millisecond)},
+		"ttl":     {2, cmdTTL(time.Second)},
+		"pttl":    {2, cmdTTL(time.Millisecond)},
+		"persist": {2, cmdPersist},
+		"rename":  {3, cmdRename},
+
+		// strings
+		"get":         {2, cmdGet},
+		"set":         {-3, cmdSet},
+		"setnx":       {3, cmdSetNX},
+		"setex":       {4, cmdSetEX(time.Second)},
+		"psetex":      {4, cmdSetEX(time.Millisecond)},
+		"getset":      {3, cmdGetSet},
+		"mget":        {-2, cmdMGet},
+		"mset":        {-3, cmdMSet},
+		"incr":        {2, cmdIncr(1)},
+		"decr":        {2, cmdIncr(-1)},
+		"incrby":      {3, cmdIncrBy(1)},
+		"decrby":      {3, cmdIncrBy(-1)},
+		"incrbyfloat": {3, cmdIncrByFloat},
+		"append":      {3, cmdAppend},
+		"strlen":      {2, cmdStrlen},
+
+		// hashes
+		"hget":    {3, cmdHGet},
+		"hset":    {-4, cmdHSet},
+		"hmset":   {-4, cmdHSet},
+		"hsetnx":  {4, cmdHSetNX},
+		"hmget":   {-3, cmdHMGet},
+		"hgetall": {2, cmdHGetAll},
+		"hdel":    {-3, cmdHDel},
+		"hexists": {3, cmdHExists},
+		"hlen":    {2, cmdHLen},
+		"hincrby": {4, cmdHIncrBy},
+		"hkeys":   {2, cmdHKeys},
+		"hvals":   {2, cmdHVals},
+		"hscan":   {-3, cmdHScan},
+
+		// lists
+		"lpush":  {-3, cmdPush(true)},
+		"rpush":  {-3, cmdPush(false)},
+		"lpop":   {2, cmdPop(true)},
+		"rpop":   {2, cmdPop(false)},
+		"llen":   {2, cmdLLen},
+		"lrange": {4, cmdLRange},
+		"ltrim":  {4, cmdLTrim},
+		"lindex": {3, cmdLIndex},
+		"lset":   {4, cmdLSet},
+		"lrem":   {4, cmdLRem},
+
+		// sets
+		"sadd":      {-3, cmdSAdd},
+		"srem":      {-3, cmdSRem},
+		"smembers":  {2, cmdSMembers},
+		"sismember": {3, cmdSIsMember},
+		"scard":     {2, cmdSCard},
+		"sscan":     {-3, cmdSScan},
+
+		// pub/sub
+		"subscribe":    {-2, cmdSubscribe(false)},
+		"psubscribe":   {-2, cmdSubscribe(true)},
+		"unsubscribe":  {-1, cmdUnsubscribe(false)},
+		"punsubscribe": {-1, cmdUnsubscribe(true)},
+		"publish":      {3, cmdPublish},
+
+		// transactions
+		"multi":   {1, cmdMulti},
+		"exec":    {1, cmdExec},
+		"discard": {1, cmdDiscard},
+		"watch":   {-2, cmdWatch},
+		"unwatch": {1, cmdUnwatch},
+	}
+}
+
+// dispatch runs or queues the command args, and returns whether the
+// connection should be closed.
+func (s *Server) dispatch(c *conn, args []string, w *reply, out *outbox) bool {
+	name := strings.ToLower(args[0])
+	cmd, ok := commands[name]
+	if h, found := s.handlers[name]; found {
+		cmd, ok = command{arity: -1, f: func(s *Server, c *conn, args []string, w *reply, out *outbox) {
+			w.value(h(args))
+		}}, true
+	}
+	if !ok {
+		w.err("ERR unknown command '" + args[0] + "'")
+		return false
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || len(args) < -cmd.arity {
+		w.err("ERR wrong number of arguments for '" + name + "' command")
+		return false
+	}
+	if name == "quit" {
+		w.ok()
+		return true
+	}
+	if s.password != "" && !c.authed && name != "auth" {
+		w.err("NOAUTH Authentication required.")
+		return false
+	}
+	if c.subscribed() {
+		switch name {
+		case "subscribe", "psubscribe", "unsubscribe", "punsubscribe", "ping":
+		default:
+			w.err("ERR Can't execute '" + name + "': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context")
+			return false
+		}
+	}
+	if c.multi {
+		switch name {
+		case "exec", "discard", "multi", "watch":
+		default:
+			c.queued = append(c.queued, args)
+			w.status("QUEUED")
+			return false
+		}
+	}
+	cmd.f(s, c, args[1:], w, out)
+	return false
+}
+
+func cmdPing(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	if len(args) > 1 {
+		w.err("ERR wrong number of arguments for 'ping' command")
+		return
+	}
+	msg := ""
+	if len(args) == 1 {
+		msg = args[0]
+	}
+	switch {
+	case c.subscribed():
+		w.strings([]string{"pong", msg})
+	case len(args) == 1:
+		w.bulk(msg)
+	default:
+		w.status("PONG")
+	}
+}
+
+func cmdEcho(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	w.bulk(args[0])
+}
+
+func cmdAuth(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	if len(args) > 2 {
+		w.err(errSyntax)
+		return
+	}
+	if s.password == "" {
+		w.err("ERR Client sent AUTH, but no password is set")
+		return
+	}
+	// The username of AUTH username password is ignored
+	if args[len(args)-1] != s.password {
+		c.authed = false
+		w.err("WRONGPASS invalid username-password pair")
+		return
+	}
+	c.authed = true
+	w.ok()
+}
+
+func cmdSelect(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	db, err := strconv.Atoi(args[0])
+	if err != nil {
+		w.err(errNotInt)
+		return
+	}
+	if db < 0 || db >= 16 {
+		w.err("ERR DB index is out of range")
+		return
+	}
+	c.db = db
+	w.ok()
+}
+
+func cmdClient(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	switch strings.ToLower(args[0]) {
+	case "setname":
+		if len(args) != 2 {
+			w.err(errSyntax)
+			return
+		}
+		c.name = args[1]
+		w.ok()
+	case "getname":
+		if c.name == "" {
+			w.nil()
+			return
+		}
+		w.bulk(c.name)
+	default:
+		w.err("ERR Unknown subcommand '" + args[0] + "'")
+	}
+}
+
+func cmdFlushDB(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	s.flush(c.db)
+	w.ok()
+}
+
+func cmdFlushAll(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	s.flush(-1)
+	w.ok()
+}
+
+func cmdDBSize(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	w.int(int64(len(s.keys(c.db, "*"))))
+}
+
+func cmdDel(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	n := 0
+	for _, key := range args {
+		if s.lookup(c.db, key) != nil && s.del(c.db, key) {
+			n++
+		}
+	}
+	w.int(int64(n))
+}
+
+func cmdExists(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	n := 0
+	for _, key := range args {
+		if s.lookup(c.db, key) != nil {
+			n++
+		}
+	}
+	w.int(int64(n))
+}
+
+func cmdType(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	it := s.lookup(c.db, args[0])
+	if it == nil {
+		w.status("none")
+		return
+	}
+	w.status(it.kind)
+}
+
+func cmdKeys(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	w.strings(s.keys(c.db, args[0]))
+}
+
+// scan replies a page of the sorted elements, the cursor is an offset.
+// Each element takes step entries of l, e.g. 2 for field and value.
+func scan(args []string, l []string, step int, w *reply) {
+	cursor, err := strconv.Atoi(args[0])
+	if err != nil || cursor < 0 {
+		w.err("ERR invalid cursor")
+		return
+	}
+	pattern, count := "*", 10
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			w.err(errSyntax)
+			return
+		}
+		switch strings.ToLower(args[i]) {
+		case "match":
+			pattern = args[i+1]
+		case "count":
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count < 1 {
+				w.err(errSyntax)
+				return
+			}
+		default:
+			w.err(errSyntax)
+			return
+		}
+	}
+
+	var page []string
+	next := cursor
+	for ; next*step < len(l) && next < cursor+count; next++ {
+		if match(pattern, l[next*step]) {
+			page = append(page, l[next*step:next*step+step]...)
+		}
+	}
+	if next*step >= len(l) {
+		next = 0
+	}
+	w.array(2)
+	w.bulk(strconv.Itoa(next))
+	w.strings(page)
+}
+
+func cmdScan(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	scan(args, s.keys(c.db, "*"), 1, w)
+}
+
+func cmdExpire(unit time.Duration) handler {
+	return func(s *Server, c *conn, args []string, w *reply, out *outbox) {
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			w.err(errNotInt)
+			return
+		}
+		it := s.lookup(c.db, args[0])
+		if it == nil {
+			w.int(0)
+			return
+		}
+		if n <= 0 {
+			s.del(c.db, args[0])
+		} else {
+			it.expireAt = s.now().Add(time.Duration(n) * unit)
+			s.touch(c.db, args[0])
+		}
+		w.int(1)
+	}
+}
+
+func cmdTTL(unit time.Duration) handler {
+	return func(s *Server, c *conn, args []string, w *reply, out *outbox) {
+		it := s.lookup(c.db, args[0])
+		switch {
+		case it == nil:
+			w.int(-2)
+		case it.expireAt.IsZero():
+			w.int(-1)
+		default:
+			// Round up as Redis does, so a live key never has a TTL of 0
+			d := it.expireAt.Sub(s.now())
+			w.int(int64((d + unit - 1) / unit))
+		}
+	}
+}
+
+func cmdPersist(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	it := s.lookup(c.db, args[0])
+	if it == nil || it.expireAt.IsZero() {
+		w.int(0)
+		return
+	}
+	it.expireAt = time.Time{}
+	s.touch(c.db, args[0])
+	w.int(1)
+}
+
+func cmdRename(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	it := s.lookup(c.db, args[0])
+	if it == nil {
+		w.err(errNoKey)
+		return
+	}
+	s.del(c.db, args[0])
+	s.put(c.db, args[1], it)
+	w.ok()
+}
+
+// typed returns the item of key if it is of kind, nil if it does not
+// exist. ok is false if a WRONGTYPE error is replied.
+func (s *Server) typed(c *conn, key, kind string, w *reply) (it *item, ok bool) {
+	it = s.lookup(c.db, key)
+	if it != nil && it.kind != kind {
+		w.err(errWrongType)
+		return nil, false
+	}
+	return it, true
+}
+
+func cmdGet(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	it, ok := s.typed(c, args[0], "string", w)
+	if !ok {
+		return
+	}
+	if it == nil {
+		w.nil()
+		return
+	}
+	w.bulk(it.str)
+}
+
+func cmdSet(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	key, value := args[0], args[1]
+	var nx, xx, keepTTL, get bool
+	var ttl time.Duration
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToLower(args[i]); opt {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "keepttl":
+			keepTTL = true
+		case "get":
+			get = true
+		case "ex", "px":
+			if i+1 >= len(args) || ttl != 0 {
+				w.err(errSyntax)
+				return
+			}
+			i++
+			n, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil {
+				w.err(errNotInt)
+				return
+			}
+			if n <= 0 {
+				w.err("ERR invalid expire time in 'set' command")
+				return
+			}
+			ttl = time.Duration(n) * time.Second
+			if opt == "px" {
+				ttl = time.Duration(n) * time.Millisecond
+			}
+		default:
+			w.err(errSyntax)
+			return
+		}
+	}
+	if (nx && xx) || (keepTTL && ttl != 0) {
+		w.err(errSyntax)
+		return
+	}
+
+	old := s.lookup(c.db, key)
+	if get && old != nil && old.kind != "string" {
+		w.err(errWrongType)
+		return
+	}
+	if (nx && old != nil) || (xx && old == nil) {
+		if get {
+			cmdGet(s, c, args[:1], w, out)
+		} else {
+			w.nil()
+		}
+		return
+	}
+	it := &item{kind: "string", str: value}
+	if ttl != 0 {
+		it.expireAt = s.now().Add(ttl)
+	} else if keepTTL && old != nil {
+		it.expireAt = old.expireAt
+	}
+	s.put(c.db, key, it)
+	switch {
+	case !get:
+		w.ok()
+	case old == nil:
+		w.nil()
+	default:
+		w.bulk(old.str)
+	}
+}
+
+func cmdSetNX(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	if s.lookup(c.db, args[0]) != nil {
+		w.int(0)
+		return
+	}
+	s.put(c.db, args[0], &item{kind: "string", str: args[1]})
+	w.int(1)
+}
+
+func cmdSetEX(unit time.Duration) handler {
+	return func(s *Server, c *conn, args []string, w *reply, out *outbox) {
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			w.err(errNotInt)
+			return
+		}
+		if n <= 0 {
+			w.err("ERR invalid expire time")
+			return
+		}
+		s.put(c.db, args[0], &item{kind: "string", str: args[2], expireAt: s.now().Add(time.Duration(n) * unit)})
+		w.ok()
+	}
+}
+
+func cmdGetSet(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	it, ok := s.typed(c, args[0], "string", w)
+	if !ok {
+		return
+	}
+	s.put(c.db, args[0], &item{kind: "string", str: args[1]})
+	if it == nil {
+		w.nil()
+		return
+	}
+	w.bulk(it.str)
+}
+
+func cmdMGet(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	w.array(len(args))
+	for _, key := range args {
+		if it := s.lookup(c.db, key); it != nil && it.kind == "string" {
+			w.bulk(it.str)
+		} else {
+			w.nil()
+		}
+	}
+}
+
+func cmdMSet(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	if len(args)%2 != 0 {
+		w.err("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+	for i := 0; i < len(args); i += 2 {
+		s.put(c.db, args[i], &item{kind: "string", str: args[i+1]})
+	}
+	w.ok()
+}
+
+// incr adds delta to the integer value of key, keeping its TTL.
+func (s *Server) incr(c *conn, key string, delta int64, w *reply) {
+	it, ok := s.typed(c, key, "string", w)
+	if !ok {
+		return
+	}
+	var n int64
+	if it != nil {
+		var err error
+		if n, err = strconv.ParseInt(it.str, 10, 64); err != nil {
+			w.err(errNotInt)
+			return
+		}
+	} else {
+		it = &item{kind: "string"}
+	}
+	n += delta
+	it.str = strconv.FormatInt(n, 10)
+	s.put(c.db, key, it)
+	w.int(n)
+}
+
+func cmdIncr(delta int64) handler {
+	return func(s *Server, c *conn, args []string, w *reply, out *outbox) {
+		s.incr(c, args[0], delta, w)
+	}
+}
+
+func cmdIncrBy(sign int64) handler {
+	return func(s *Server, c *conn, args []string, w *reply, out *outbox) {
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			w.err(errNotInt)
+			return
+		}
+		s.incr(c, args[0], sign*n, w)
+	}
+}
+
+func cmdIncrByFloat(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	delta, err := strconv.ParseFloat(args[1], 64)
+	if err != nil {
+		w.err(errNotFloat)
+		return
+	}
+	it, ok := s.typed(c, args[0], "string", w)
+	if !ok {
+		return
+	}
+	var f float64
+	if it != nil {
+		if f, err = strconv.ParseFloat(it.str, 64); err != nil {
+			w.err(errNotFloat)
+			return
+		}
+	} else {
+		it = &item{kind: "string"}
+	}
+	it.str = strconv.FormatFloat(f+delta, 'f', -1, 64)
+	s.put(c.db, args[0], it)
+	w.bulk(it.str)
+}
+
+func cmdAppend(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	it, ok := s.typed(c, args[0], "string", w)
+	if !ok {
+		return
+	}
+	if it == nil {
+		it = &item{kind: "string"}
+	}
+	it.str += args[1]
+	s.put(c.db, args[0], it)
+	w.int(int64(len(it.str)))
+}
+
+func cmdStrlen(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	it, ok := s.typed(c, args[0], "string", w)
+	if !ok {
+		return
+	}
+	if it == nil {
+		w.int(0)
+		return
+	}
+	w.int(int64(len(it.str)))
+}
+
+func cmdHGet(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	it, ok := s.typed(c, args[0], "hash", w)
+	if !ok {
+		return
+	}
+	if it == nil {
+		w.nil()
+		return
+	}
+	v, ok := it.hash[args[1]]
+	if !ok {
+		w.nil()
+		return
+	}
+	w.bulk(v)
+}
+
+// hash returns the hash of key, creating it if it does not exist.
+func (s *Server) hash(c *conn, key string, w *reply) (*item, bool) {
+	it, ok := s.typed(c, key, "hash", w)
+	if ok && it == nil {
+		it = &item{kind: "hash", hash: make(map[string]string)}
+		s.put(c.db, key, it)
+	}
+	return it, ok
+}
+
+func cmdHSet(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	if len(args)%2 != 1 {
+		w.err("ERR wrong number of arguments for 'hset' command")
+		return
+	}
+	it, ok := s.hash(c, args[0], w)
+	if !ok {
+		return
+	}
+	n := 0
+	for i := 1; i < len(args); i += 2 {
+		if _, ok := it.hash[args[i]]; !ok {
+			n++
+		}
+		it.hash[args[i]] = args[i+1]
+	}
+	s.touch(c.db, args[0])
+	w.int(int64(n))
+}
+
+func cmdHSetNX(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	it, ok := s.hash(c, args[0], w)
+	if !ok {
+		return
+	}
+	if _, ok := it.hash[args[1]]; ok {
+		w.int(0)
+		return
+	}
+	it.hash[args[1]] = args[2]
+	s.touch(c.db, args[0])
+	w.int(1)
+}
+
+func cmdHMGet(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	it, ok := s.typed(c, args[0], "hash", w)
+	if !ok {
+		return
+	}
+	w.array(len(args) - 1)
+	for _, field := range args[1:] {
+		if v, ok := it.fields()[field]; ok {
+			w.bulk(v)
+		} else {
+			w.nil()
+		}
+	}
+}
+
+// fields returns the hash of the item, nil if it does not exist.
+func (it *item) fields() map[string]string {
+	if it == nil {
+		return nil
+	}
+	return it.hash
+}
+
+// sortedFields returns the fields of the hash followed by their values.
+func (it *item) sortedFields() (l []string) {
+	keys := make([]string, 0, len(it.fields()))
+	for k := range it.fields() {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		l = append(l, k, it.hash[k])
+	}
+	return
+}
+
+func cmdHGetAll(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	it, ok := s.typed(c, args[0], "hash", w)
+	if !ok {
+		return
+	}
+	w.strings(it.sortedFields())
+}
+
+func cmdHDel(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	it, ok := s.typed(c, args[0], "hash", w)
+	if !ok {
+		return
+	}
+	n := 0
+	for _, field := range args[1:] {
+		if _, ok := it.fields()[field]; ok {
+			delete(it.hash, field)
+			n++
+		}
+	}
+	if n > 0 {
+		s.touch(c.db, args[0])
+		if len(it.hash) == 0 {
+			s.del(c.db, args[0])
+		}
+	}
+	w.int(int64(n))
+}
+
+func cmdHExists(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	it, ok := s.typed(c, args[0], "hash", w)
+	if !ok {
+		return
+	}
+	_, ok = it.fields()[args[1]]
+	w.bool(ok)
+}
+
+func cmdHLen(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	it, ok := s.typed(c, args[0], "hash", w)
+	if !ok {
+		return
+	}
+	w.int(int64(len(it.fields())))
+}
+
+func cmdHIncrBy(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	delta, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		w.err(errNotInt)
+		return
+	}
+	it, ok := s.typed(c, args[0], "hash", w)
+	if !ok {
+		return
+	}
+	var n int64
+	if v, ok := it.fields()[args[1]]; ok {
+		if n, err = strconv.ParseInt(v, 10, 64); err != nil {
+			w.err("ERR hash value is not an integer")
+			return
+		}
+	}
+	if it, ok = s.hash(c, args[0], w); !ok {
+		return
+	}
+	n += delta
+	it.hash[args[1]] = strconv.FormatInt(n, 10)
+	s.touch(c.db, args[0])
+	w.int(n)
+}
+
+func cmdHKeys(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	it, ok := s.typed(c, args[0], "hash", w)
+	if !ok {
+		return
+	}
+	l := it.sortedFields()
+	keys := make([]string, 0, len(l)/2)
+	for i := 0; i < len(l); i += 2 {
+		keys = append(keys, l[i])
+	}
+	w.strings(keys)
+}
+
+func cmdHVals(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	it, ok := s.typed(c, args[0], "hash", w)
+	if !ok {
+		return
+	}
+	l := it.sortedFields()
+	values := make([]string, 0, len(l)/2)
+	for i := 1; i < len(l); i += 2 {
+		values = append(values, l[i])
+	}
+	w.strings(values)
+}
+
+func cmdHScan(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	it, ok := s.typed(c, args[0], "hash", w)
+	if !ok {
+		return
+	}
+	scan(args[1:], it.sortedFields(), 2, w)
+}
+
+func cmdPush(left bool) handler {
+	return func(s *Server, c *conn, args []string, w *reply, out *outbox) {
+		it, ok := s.typed(c, args[0], "list", w)
+		if !ok {
+			return
+		}
+		if it == nil {
+			it = &item{kind: "list"}
+		}
+		for _, v := range args[1:] {
+			if left {
+				it.list = append([]string{v}, it.list...)
+			} else {
+				it.list = append(it.list, v)
+			}
+		}
+		s.put(c.db, args[0], it)
+		w.int(int64(len(it.list)))
+	}
+}
+
+func cmdPop(left bool) handler {
+	return func(s *Server, c *conn, args []string, w *reply, out *outbox) {
+		it, ok := s.typed(c, args[0], "list", w)
+		if !ok {
+			return
+		}
+		if it == nil {
+			w.nil()
+			return
+		}
+		var v string
+		if left {
+			v, it.list = it.list[0], it.list[1:]
+		} else {
+			v, it.list = it.list[len(it.list)-1], it.list[:len(it.list)-1]
+		}
+		s.touch(c.db, args[0])
+		if len(it.list) == 0 {
+			s.del(c.db, args[0])
+		}
+		w.bulk(v)
+	}
+}
+
+func cmdLLen(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	it, ok := s.typed(c, args[0], "list", w)
+	if !ok {
+		return
+	}
+	if it == nil {
+		w.int(0)
+		return
+	}
+	w.int(int64(len(it.list)))
+}
+
+// span converts the inclusive start and stop indexes of LRANGE, which may be
+// negative from the end, to a slice range of a list of n elements.
+func span(start, stop string, n int) (lo, hi int, ok bool) {
+	i, err1 := strconv.Atoi(start)
+	j, err2 := strconv.Atoi(stop)
+	if err1 != nil || err2 != nil {
+		return 0, 0, false
+	}
+	if i < 0 {
+		i += n
+	}
+	if j < 0 {
+		j += n
+	}
+	if i < 0 {
+		i = 0
+	}
+	if j >= n {
+		j = n - 1
+	}
+	if i > j {
+		return 0, 0, true
+	}
+	return i, j + 1, true
+}
+
+func cmdLRange(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	it, ok := s.typed(c, args[0], "list", w)
+	if !ok {
+		return
+	}
+	var l []string
+	if it != nil {
+		l = it.list
+	}
+	lo, hi, ok := span(args[1], args[2], len(l))
+	if !ok {
+		w.err(errNotInt)
+		return
+	}
+	w.strings(l[lo:hi])
+}
+
+func cmdLTrim(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	it, ok := s.typed(c, args[0], "list", w)
+	if !ok {
+		return
+	}
+	if it == nil {
+		w.ok()
+		return
+	}
+	lo, hi, ok := span(args[1], args[2], len(it.list))
+	if !ok {
+		w.err(errNotInt)
+		return
+	}
+	it.list = it.list[lo:hi]
+	s.touch(c.db, args[0])
+	if len(it.list) == 0 {
+		s.del(c.db, args[0])
+	}
+	w.ok()
+}
+
+// index converts a list index, which may be negative from the end.
+func index(s string, n int) (int, bool) {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, false
+	}
+	if i < 0 {
+		i += n
+	}
+	return i, true
+}
+
+func cmdLIndex(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	it, ok := s.typed(c, args[0], "list", w)
+	if !ok {
+		return
+	}
+	if it == nil {
+		w.nil()
+		return
+	}
+	i, ok := index(args[1], len(it.list))
+	if !ok {
+		w.err(errNotInt)
+		return
+	}
+	if i < 0 || i >= len(it.list) {
+		w.nil()
+		return
+	}
+	w.bulk(it.list[i])
+}
+
+func cmdLSet(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	it, ok := s.typed(c, args[0], "list", w)
+	if !ok {
+		return
+	}
+	if it == nil {
+		w.err(errNoKey)
+		return
+	}
+	i, ok := index(args[1], len(it.list))
+	if !ok {
+		w.err(errNotInt)
+		return
+	}
+	if i < 0 || i >= len(it.list) {
+		w.err("ERR index out of range")
+		return
+	}
+	it.list[i] = args[2]
+	s.touch(c.db, args[0])
+	w.ok()
+}
+
+func cmdLRem(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	count, err := strconv.Atoi(args[1])
+	if err != nil {
+		w.err(errNotInt)
+		return
+	}
+	it, ok := s.typed(c, args[0], "list", w)
+	if !ok {
+		return
+	}
+	if it == nil {
+		w.int(0)
+		return
+	}
+	// Remove from the tail if count is negative, all if zero
+	l := it.list
+	removed := make([]bool, len(l))
+	n := 0
+	for k := 0; k < len(l); k++ {
+		i := k
+		if count < 0 {
+			i = len(l) - 1 - k
+		}
+		if l[i] != args[2] {
+			continue
+		}
+		removed[i] = true
+		n++
+		if count != 0 && (n == count || n == -count) {
+			break
+		}
+	}
+	var kept []string
+	for i, v := range l {
+		if !removed[i] {
+			kept = append(kept, v)
+		}
+	}
+	it.list = kept
+	if n > 0 {
+		s.touch(c.db, args[0])
+		if len(kept) == 0 {
+			s.del(c.db, args[0])
+		}
+	}
+	w.int(int64(n))
+}
+
+// members returns the sorted members of the set, nil if it does not exist.
+func (it *item) members() []string {
+	if it == nil {
+		return nil
+	}
+	l := make([]string, 0, len(it.set))
+	for m := range it.set {
+		l = append(l, m)
+	}
+	sort.Strings(l)
+	return l
+}
+
+func cmdSAdd(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	it, ok := s.typed(c, args[0], "set", w)
+	if !ok {
+		return
+	}
+	if it == nil {
+		it = &item{kind: "set", set: make(map[string]bool)}
+	}
+	n := 0
+	for _, m := range args[1:] {
+		if !it.set[m] {
+			it.set[m] = true
+			n++
+		}
+	}
+	s.put(c.db, args[0], it)
+	w.int(int64(n))
+}
+
+func cmdSRem(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	it, ok := s.typed(c, args[0], "set", w)
+	if !ok {
+		return
+	}
+	if it == nil {
+		w.int(0)
+		return
+	}
+	n := 0
+	for _, m := range args[1:] {
+		if it.set[m] {
+			delete(it.set, m)
+			n++
+		}
+	}
+	if n > 0 {
+		s.touch(c.db, args[0])
+		if len(it.set) == 0 {
+			s.del(c.db, args[0])
+		}
+	}
+	w.int(int64(n))
+}
+
+func cmdSMembers(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	it, ok := s.typed(c, args[0], "set", w)
+	if !ok {
+		return
+	}
+	w.strings(it.members())
+}
+
+func cmdSIsMember(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	it, ok := s.typed(c, args[0], "set", w)
+	if !ok {
+		return
+	}
+	w.bool(it != nil && it.set[args[1]])
+}
+
+func cmdSCard(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	it, ok := s.typed(c, args[0], "set", w)
+	if !ok {
+		return
+	}
+	w.int(int64(len(it.members())))
+}
+
+func cmdSScan(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	it, ok := s.typed(c, args[0], "set", w)
+	if !ok {
+		return
+	}
+	scan(args[1:], it.members(), 1, w)
+}
+
+// subscription replies a (un)subscribe confirmation with the number of
+// subscriptions of the connection.
+func subscription(c *conn, kind string, name *string, w *reply) {
+	w.array(3)
+	w.bulk(kind)
+	if name == nil {
+		w.nil()
+	} else {
+		w.bulk(*name)
+	}
+	w.int(int64(len(c.channels) + len(c.patterns)))
+}
+
+func cmdSubscribe(pattern bool) handler {
+	return func(s *Server, c *conn, args []string, w *reply, out *outbox) {
+		kind := "subscribe"
+		if c.channels == nil {
+			c.channels = make(map[string]bool)
+			c.patterns = make(map[string]bool)
+		}
+		subs := c.channels
+		if pattern {
+			kind = "psubscribe"
+			subs = c.patterns
+		}
+		for i := range args {
+			subs[args[i]] = true
+			subscription(c, kind, &args[i], w)
+		}
+	}
+}
+
+func cmdUnsubscribe(pattern bool) handler {
+	return func(s *Server, c *conn, args []string, w *reply, out *outbox) {
+		kind, subs := "unsubscribe", c.channels
+		if pattern {
+			kind, subs = "punsubscribe", c.patterns
+		}
+		if len(args) == 0 {
+			for name := range subs {
+				args = append(args, name)
+			}
+			sort.Strings(args)
+		}
+		if len(args) == 0 {
+			subscription(c, kind, nil, w)
+			return
+		}
+		for i := range args {
+			delete(subs, args[i])
+			subscription(c, kind, &args[i], w)
+		}
+	}
+}
+
+func cmdPublish(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	deliveries := s.publish(args[0], args[1])
+	*out = append(*out, deliveries...)
+	w.int(int64(len(deliveries)))
+}
+
+func cmdMulti(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	if c.multi {
+		w.err("ERR MULTI calls can not be nested")
+		return
+	}
+	c.multi = true
+	w.ok()
+}
+
+func cmdExec(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	if !c.multi {
+		w.err("ERR EXEC without MULTI")
+		return
+	}
+	queued, watched := c.queued, c.watched
+	c.multi, c.queued, c.watched = false, nil, nil
+	for key, v := range watched {
+		if s.versions[key] != v {
+			w.nilArray()
+			return
+		}
+	}
+	w.array(len(queued))
+	for _, args := range queued {
+		s.dispatch(c, args, w, out)
+	}
+}
+
+func cmdDiscard(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	if !c.multi {
+		w.err("ERR DISCARD without MULTI")
+		return
+	}
+	c.multi, c.queued, c.watched = false, nil, nil
+	w.ok()
+}
+
+func cmdWatch(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	if c.multi {
+		w.err("ERR WATCH inside MULTI is not allowed")
+		return
+	}
+	if c.watched == nil {
+		c.watched = make(map[dbKey]uint64)
+	}
+	for _, key := range args {
+		// Expire the key now, so that expiring later counts as a change
+		s.lookup(c.db, key)
+		k := dbKey{c.db, key}
+		if _, ok := c.watched[k]; !ok {
+			c.watched[k] = s.versions[k]
+		}
+	}
+	w.ok()
+}
+
+func cmdUnwatch(s *Server, c *conn, args []string, w *reply, out *outbox) {
+	c.watched = nil
+	w.ok()
+}
@@ -0,0 +1,574 @@
+// Package redistest provides an in-process Redis server on a loopback port,
+// so that code using the redis package can be tested end-to-end without a
+// real Redis.
+//
+//	s := redistest.NewServer()
+//	defer s.Close()
+//	p := redis.NewRedisPool([]string{s.Addr()}, redis.DefaultRedisPooledConnFactory, redis.DefaultPoolConfig)
+//
+// Strings, hashes, lists, sets, expiration, transactions and pub/sub are
+// supported. Scripting, streams, sorted sets, cluster and sentinel commands
+// are not, but tests can answer them by Handle.
+package redistest
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is an in-memory Redis server speaking RESP.
+type Server struct {
+	l net.Listener
+
+	// Guards all below, commands run one at a time as in Redis
+	mu       sync.Mutex
+	password string
+	dbs      map[int]map[string]*item
+	// Bumped by every write of a key, for WATCH
+	versions map[dbKey]uint64
+	// Added to the clock by FastForward
+	offset time.Duration
+	conns  map[*conn]bool
+	closed bool
+	// Commands answered by Handle
+	handlers map[string]Handler
+
+	wg sync.WaitGroup
+}
+
+// dbKey is a key of a database.
+type dbKey struct {
+	db  int
+	key string
+}
+
+// item is the value of a key.
+type item struct {
+	// One of "string", "hash", "list" and "set"
+	kind     string
+	str      string
+	hash     map[string]string
+	list     []string
+	set      map[string]bool
+	expireAt time.Time
+}
+
+// NewServer starts a server on a random loopback port, it panics if it can
+// not listen like httptest.NewServer.
+func NewServer() *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("redistest: failed to listen: %v", err))
+	}
+	s := &Server{
+		l:        l,
+		dbs:      make(map[int]map[string]*item),
+		versions: make(map[dbKey]uint64),
+		conns:    make(map[*conn]bool),
+		handlers: make(map[string]Handler),
+	}
+	s.wg.Add(1)
+	go s.accept()
+	return s
+}
+
+// Addr returns the address of the server, e.g. "127.0.0.1:51234".
+func (s *Server) Addr() string {
+	return s.l.Addr().String()
+}
+
+// Close closes the listener and all connections.
+func (s *Server) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.l.Close()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// RequirePassword makes AUTH required on new commands, empty disables it.
+func (s *Server) RequirePassword(password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.password = password
+}
+
+// Handler answers a command registered by Server.Handle, args are the
+// arguments without the command name. The returned value is written as:
+//
+//	nil                       nil bulk string
+//	string, []byte            bulk string
+//	int, int64                integer
+//	Status, Error             status and error, e.g. Error("NOSCRIPT No matching script")
+//	[]string, []interface{}   array of the values above
+//	NilArray                  nil array
+//	NoReply                   nothing, e.g. to act as a hung server
+//
+// Handlers run one at a time with the server locked, so they must not call
+// the methods of Server.
+type Handler func(args []string) interface{}
+
+// Status is a simple string reply, e.g. Status("OK").
+type Status string
+
+// Error is an error reply, e.g. Error("ERR unknown").
+type Error string
+
+type marker int
+
+const (
+	// NilArray is the nil array reply, e.g. of an aborted EXEC.
+	NilArray marker = iota
+	// NoReply writes no reply, it must not be returned in MULTI.
+	NoReply
+)
+
+// Handle answers command name by h, in place of the built-in command if any,
+// and with no check of the number of arguments.
+func (s *Server) Handle(name string, h Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[strings.ToLower(name)] = h
+}
+
+// FastForward moves the clock of the server forward, expiring keys.
+func (s *Server) FastForward(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offset += d
+}
+
+// Get returns the string value of key in database 0.
+func (s *Server) Get(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it := s.lookup(0, key)
+	if it == nil || it.kind != "string" {
+		return "", false
+	}
+	return it.str, true
+}
+
+// Set sets the string value of key in database 0.
+func (s *Server) Set(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.put(0, key, &item{kind: "string", str: value})
+}
+
+// Keys returns the sorted keys of database 0.
+func (s *Server) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys(0, "*")
+}
+
+// FlushAll deletes all keys of all databases.
+func (s *Server) FlushAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flush(-1)
+}
+
+// Publish publishes message on channel, and returns the number of receivers.
+func (s *Server) Publish(channel, message string) int {
+	s.mu.Lock()
+	out := s.publish(channel, message)
+	s.mu.Unlock()
+	out.send()
+	return len(out)
+}
+
+// DropConnections closes the client connections, e.g. to test reconnects.
+// Their subscriptions are gone at once, so Publish counts only new ones.
+func (s *Server) DropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.Close()
+		delete(s.conns, c)
+	}
+}
+
+func (s *Server) now() time.Time {
+	return time.Now().Add(s.offset)
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		nc, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		c := &conn{Conn: nc, w: bufio.NewWriter(nc)}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			nc.Close()
+			return
+		}
+		s.conns[c] = true
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.serve(c)
+	}
+}
+
+// conn is a client connection and its state.
+type conn struct {
+	net.Conn
+
+	// Guards w, which is also written by PUBLISH of other connections
+	wmu sync.Mutex
+	w   *bufio.Writer
+
+	// Guarded by Server.mu
+	db       int
+	authed   bool
+	name     string
+	channels map[string]bool
+	patterns map[string]bool
+	multi    bool
+	queued   [][]string
+	// Key versions at WATCH
+	watched map[dbKey]uint64
+}
+
+func (c *conn) write(b []byte) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.w.Write(b)
+	c.w.Flush()
+}
+
+func (c *conn) subscribed() bool {
+	return len(c.channels)+len(c.patterns) > 0
+}
+
+func (s *Server) serve(c *conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		c.Close()
+	}()
+	r := bufio.NewReader(c)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		w := &reply{}
+		var out outbox
+		s.mu.Lock()
+		quit := s.dispatch(c, args, w, &out)
+		s.mu.Unlock()
+		c.write(w.Bytes())
+		out.send()
+		if quit {
+			return
+		}
+	}
+}
+
+// readCommand reads a RESP array of bulk strings, or an inline command.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, errors.New("redistest: invalid multibulk length")
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		if line, err = readLine(r); err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errors.New("redistest: expected bulk string")
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, errors.New("redistest: invalid bulk length")
+		}
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// reply buffers the RESP reply of a command.
+type reply struct {
+	bytes.Buffer
+}
+
+func (w *reply) ok() {
+	w.WriteString("+OK\r\n")
+}
+
+func (w *reply) status(s string) {
+	fmt.Fprintf(w, "+%s\r\n", s)
+}
+
+func (w *reply) err(s string) {
+	fmt.Fprintf(w, "-%s\r\n", s)
+}
+
+func (w *reply) int(n int64) {
+	fmt.Fprintf(w, ":%d\r\n", n)
+}
+
+func (w *reply) bool(b bool) {
+	if b {
+		w.int(1)
+	} else {
+		w.int(0)
+	}
+}
+
+func (w *reply) bulk(s string) {
+	fmt.Fprintf(w, "$%d\r\n%s\r\n", len(s), s)
+}
+
+func (w *reply) nil() {
+	w.WriteString("$-1\r\n")
+}
+
+func (w *reply) nilArray() {
+	w.WriteString("*-1\r\n")
+}
+
+func (w *reply) array(n int) {
+	fmt.Fprintf(w, "*%d\r\n", n)
+}
+
+func (w *reply) strings(l []string) {
+	w.array(len(l))
+	for _, s := range l {
+		w.bulk(s)
+	}
+}
+
+// value writes the reply of a Handler.
+func (w *reply) value(v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		w.nil()
+	case string:
+		w.bulk(v)
+	case []byte:
+		w.bulk(string(v))
+	case int:
+		w.int(int64(v))
+	case int64:
+		w.int(v)
+	case Status:
+		w.status(string(v))
+	case Error:
+		w.err(string(v))
+	case []string:
+		w.strings(v)
+	case []interface{}:
+		w.array(len(v))
+		for _, e := range v {
+			w.value(e)
+		}
+	case marker:
+		if v == NilArray {
+			w.nilArray()
+		}
+	default:
+		panic(fmt.Sprintf("redistest: unsupported reply %T", v))
+	}
+}
+
+// delivery is a message to write on another connection once Server.mu is released.
+type delivery struct {
+	c    *conn
+	data []byte
+}
+
+type outbox []delivery
+
+func (out outbox) send() {
+	for _, d := range out {
+		d.c.write(d.data)
+	}
+}
+
+func (s *Server) db(n int) map[string]*item {
+	db, ok := s.dbs[n]
+	if !ok {
+		db = make(map[string]*item)
+		s.dbs[n] = db
+	}
+	return db
+}
+
+// lookup returns the item of key, deleting it if expired.
+func (s *Server) lookup(db int, key string) *item {
+	it, ok := s.db(db)[key]
+	if !ok {
+		return nil
+	}
+	if !it.expireAt.IsZero() && !s.now().Before(it.expireAt) {
+		s.del(db, key)
+		return nil
+	}
+	return it
+}
+
+func (s *Server) put(db int, key string, it *item) {
+	s.db(db)[key] = it
+	s.touch(db, key)
+}
+
+func (s *Server) del(db int, key string) bool {
+	if _, ok := s.db(db)[key]; !ok {
+		return false
+	}
+	delete(s.db(db), key)
+	s.touch(db, key)
+	return true
+}
+
+// touch marks key as modified for WATCH.
+func (s *Server) touch(db int, key string) {
+	s.versions[dbKey{db, key}]++
+}
+
+// flush deletes the keys of db, or of all databases if db is negative.
+func (s *Server) flush(db int) {
+	for n, keys := range s.dbs {
+		if db >= 0 && n != db {
+			continue
+		}
+		for key := range keys {
+			s.del(n, key)
+		}
+	}
+}
+
+// keys returns the sorted live keys of db matching pattern.
+func (s *Server) keys(db int, pattern string) (keys []string) {
+	for key := range s.db(db) {
+		if s.lookup(db, key) != nil && match(pattern, key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return
+}
+
+// publish returns the deliveries of a message to the subscribers of channel.
+func (s *Server) publish(channel, message string) (out outbox) {
+	for c := range s.conns {
+		if c.channels[channel] {
+			w := &reply{}
+			w.strings([]string{"message", channel, message})
+			out = append(out, delivery{c, w.Bytes()})
+		}
+		for pattern := range c.patterns {
+			if match(pattern, channel) {
+				w := &reply{}
+				w.strings([]string{"pmessage", pattern, channel, message})
+				out = append(out, delivery{c, w.Bytes()})
+			}
+		}
+	}
+	return
+}
+
+// match reports whether s matches the glob style pattern of KEYS and PSUBSCRIBE.
+func match(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if match(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '[':
+			end := strings.IndexByte(pattern, ']')
+			if end < 0 || len(s) == 0 {
+				return false
+			}
+			set := pattern[1:end]
+			negate := len(set) > 0 && set[0] == '^'
+			if negate {
+				set = set[1:]
+			}
+			found := false
+			for i := 0; i < len(set); i++ {
+				if i+2 < len(set) && set[i+1] == '-' {
+					if set[i] <= s[0] && s[0] <= set[i+2] {
+						found = true
+					}
+					i += 2
+				} else if set[i] == s[0] {
+					found = true
+				}
+			}
+			if found == negate {
+				return false
+			}
+			pattern = pattern[end:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+	return len(s) == 0
+}
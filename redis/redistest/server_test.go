@@ -0,0 +1,192 @@
+package redistest
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func dial(t *testing.T, s *Server) redis.Conn {
+	c, err := redis.Dial("tcp", s.Addr(), redis.DialReadTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestServerCommands(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	c := dial(t, s)
+	defer c.Close()
+
+	if v, err := redis.String(c.Do("SET", "k", "v", "EX", 10)); err != nil || v != "OK" {
+		t.Fatalf("set %v %v", v, err)
+	}
+	if v, err := redis.String(c.Do("GET", "k")); err != nil || v != "v" {
+		t.Errorf("get %v %v", v, err)
+	}
+	if ok, _ := redis.Bool(c.Do("SET", "k", "w", "NX")); ok {
+		t.Error("set nx on existing key")
+	}
+	if n, _ := redis.Int(c.Do("TTL", "k")); n != 10 {
+		t.Errorf("ttl %d", n)
+	}
+	s.FastForward(10 * time.Second)
+	if _, err := redis.String(c.Do("GET", "k")); err != redis.ErrNil {
+		t.Errorf("key not expired: %v", err)
+	}
+	if n, _ := redis.Int(c.Do("INCRBY", "n", 5)); n != 5 {
+		t.Errorf("incrby %d", n)
+	}
+
+	c.Do("HSET", "h", "a", 1, "b", 2)
+	if m, _ := redis.StringMap(c.Do("HGETALL", "h")); !reflect.DeepEqual(m, map[string]string{"a": "1", "b": "2"}) {
+		t.Errorf("hgetall %v", m)
+	}
+	c.Do("RPUSH", "l", "a", "b", "c")
+	c.Do("LPUSH", "l", "z")
+	if l, _ := redis.Strings(c.Do("LRANGE", "l", 1, -1)); !reflect.DeepEqual(l, []string{"a", "b", "c"}) {
+		t.Errorf("lrange %v", l)
+	}
+	c.Do("SADD", "s", "x", "y", "x")
+	if l, _ := redis.Strings(c.Do("SMEMBERS", "s")); !reflect.DeepEqual(l, []string{"x", "y"}) {
+		t.Errorf("smembers %v", l)
+	}
+	if _, err := c.Do("GET", "s"); err == nil || err.Error()[:9] != "WRONGTYPE" {
+		t.Errorf("get of set: %v", err)
+	}
+	if l, _ := redis.Strings(c.Do("KEYS", "[hl]")); !reflect.DeepEqual(l, []string{"h", "l"}) {
+		t.Errorf("keys %v", l)
+	}
+	if _, err := c.Do("EVAL", "return 1", 0); err == nil {
+		t.Error("eval should be unknown")
+	}
+
+	// A key changed after WATCH aborts the transaction
+	c.Do("WATCH", "n")
+	s.Set("n", "0")
+	c.Send("MULTI")
+	c.Send("INCR", "n")
+	if v, err := c.Do("EXEC"); err != nil || v != nil {
+		t.Errorf("exec of changed key %v %v", v, err)
+	}
+	c.Send("MULTI")
+	c.Send("INCR", "n")
+	if v, err := redis.Ints(c.Do("EXEC")); err != nil || !reflect.DeepEqual(v, []int{1}) {
+		t.Errorf("exec %v %v", v, err)
+	}
+}
+
+func TestServerAuth(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.RequirePassword("secret")
+	c := dial(t, s)
+	defer c.Close()
+
+	if _, err := c.Do("GET", "k"); err == nil {
+		t.Error("command without auth")
+	}
+	if _, err := c.Do("AUTH", "wrong"); err == nil {
+		t.Error("auth with wrong password")
+	}
+	if _, err := c.Do("AUTH", "default", "secret"); err != nil {
+		t.Error(err)
+	}
+	if _, err := c.Do("SELECT", 1); err != nil {
+		t.Error(err)
+	}
+	c.Do("SET", "k", "v")
+	if _, ok := s.Get("k"); ok {
+		t.Error("key set in database 1 found in database 0")
+	}
+}
+
+func TestServerPubSub(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	sub := redis.PubSubConn{Conn: dial(t, s)}
+	defer sub.Close()
+	sub.Subscribe("news")
+	sub.PSubscribe("news.*")
+	for i := 0; i < 2; i++ {
+		if _, ok := sub.Receive().(redis.Subscription); !ok {
+			t.Fatal("subscription not confirmed")
+		}
+	}
+	if _, err := sub.Conn.Do("GET", "k"); err == nil {
+		t.Error("get in subscribed mode")
+	}
+
+	c := dial(t, s)
+	defer c.Close()
+	if n, _ := redis.Int(c.Do("PUBLISH", "news", "hello")); n != 1 {
+		t.Errorf("publish receivers %d", n)
+	}
+	if m, ok := sub.Receive().(redis.Message); !ok || m.Channel != "news" || string(m.Data) != "hello" {
+		t.Errorf("message %+v", m)
+	}
+	if n := s.Publish("news.sport", "goal"); n != 1 {
+		t.Errorf("publish receivers %d", n)
+	}
+	if m, ok := sub.Receive().(redis.PMessage); !ok || m.Pattern != "news.*" || string(m.Data) != "goal" {
+		t.Errorf("pmessage %+v", m)
+	}
+}
+
+func TestServerHandle(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.Handle("EVAL", func(args []string) interface{} {
+		switch args[0] {
+		case "error":
+			return Error("NOSCRIPT No matching script")
+		case "hang":
+			return NoReply
+		}
+		return []interface{}{args[0], 1, nil, []string{"a"}, Status("OK")}
+	})
+	s.Handle("get", func(args []string) interface{} {
+		return "handled"
+	})
+	c := dial(t, s)
+	defer c.Close()
+
+	v, err := redis.Values(c.Do("EVAL", "script", 0))
+	if err != nil || !reflect.DeepEqual(v, []interface{}{[]byte("script"), int64(1), nil, []interface{}{[]byte("a")}, "OK"}) {
+		t.Errorf("eval %v %v", v, err)
+	}
+	if _, err = c.Do("EVAL", "error", 0); err == nil || err.Error() != "NOSCRIPT No matching script" {
+		t.Errorf("eval error %v", err)
+	}
+	if v, _ := redis.String(c.Do("GET", "k")); v != "handled" {
+		t.Errorf("built-in get not replaced, %q", v)
+	}
+	if _, err = redis.DoWithTimeout(c, 50*time.Millisecond, "EVAL", "hang", 0); err == nil {
+		t.Error("reply to a hung command")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	for _, tt := range []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "", true},
+		{"user:*", "user:1", true},
+		{"user:*", "order:1", false},
+		{"h?llo", "hello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{`a\*`, "a*", true},
+		{`a\*`, "ab", false},
+	} {
+		if got := match(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("match(%q, %q) = %v", tt.pattern, tt.s, got)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package redis
+
+import (
+	"context"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ScanIterator walks the pages of SCAN, HSCAN, SSCAN or ZSCAN.
+//
+//	it := pool.Cmd().Scan(ctx, "user:*", 100)
+//	for it.Next() {
+//		key := it.Val()
+//	}
+//	if err := it.Err(); err != nil {
+//	}
+//
+// SCAN walks every shard, or every master in cluster mode. Elements may be returned more
+// than once, as documented by Redis.
+type ScanIterator struct {
+	ctx     context.Context
+	c       *Cmd
+	command string
+	key     string
+	match   string
+	count   int
+	// HSCAN and ZSCAN return field and value pairs
+	step int
+
+	// Masters to walk in cluster mode, or shards of dp otherwise, and the
+	// current one
+	nodes  []string
+	dp     *Pool
+	shards []*PoolShard
+	node   int
+
+	cursor  string
+	started bool
+	page    []string
+	val     string
+	value   string
+	err     error
+}
+
+// Scan iterates keys matching match, count is a hint of the page size, zero for default.
+func (c *Cmd) Scan(ctx context.Context, match string, count int) *ScanIterator {
+	it := c.newScan(ctx, "SCAN", "", match, count, 1)
+	if c.p.cluster != nil {
+		it.nodes = c.p.cluster.masters()
+	} else {
+		it.dp = c.p.pool()
+		it.shards = it.dp.Shards()
+	}
+	return it
+}
+
+// HScan iterates fields of a hash, Value returns the value of the field.
+func (c *Cmd) HScan(ctx context.Context, key, match string, count int) *ScanIterator {
+	return c.newScan(ctx, "HSCAN", key, match, count, 2)
+}
+
+func (c *Cmd) SScan(ctx context.Context, key, match string, count int) *ScanIterator {
+	return c.newScan(ctx, "SSCAN", key, match, count, 1)
+}
+
+// ZScan iterates members of a sorted set, Value returns the score of the member.
+func (c *Cmd) ZScan(ctx context.Context, key, match string, count int) *ScanIterator {
+	return c.newScan(ctx, "ZSCAN", key, match, count, 2)
+}
+
+func (c *Cmd) newScan(ctx context.Context, command, key, match string, count, step int) *ScanIterator {
+	return &ScanIterator{ctx: ctx, c: c, command: command, key: key, match: match, count: count, step: step, cursor: "0"}
+}
+
+// Next advances to the next element, it returns false when done or on error.
+func (it *ScanIterator) Next() bool {
+	for {
+		if len(it.page) >= it.step {
+			it.val = it.page[0]
+			if it.step == 2 {
+				it.value = it.page[1]
+			}
+			it.page = it.page[it.step:]
+			return true
+		}
+		if it.err != nil {
+			return false
+		}
+		if it.started && it.cursor == "0" {
+			if it.node+1 >= len(it.nodes)+len(it.shards) {
+				return false
+			}
+			it.node++
+			it.started = false
+		}
+		it.err = it.fetch()
+		it.started = true
+	}
+}
+
+// Val returns the key, field or member of the current element.
+func (it *ScanIterator) Val() string {
+	return it.val
+}
+
+// Value returns the hash value of HScan or the score of ZScan.
+func (it *ScanIterator) Value() string {
+	return it.value
+}
+
+func (it *ScanIterator) Err() error {
+	return it.err
+}
+
+func (it *ScanIterator) fetch() error {
+	args := redis.Args{}
+	if it.key != "" {
+		args = args.Add(it.key)
+	}
+	args = args.Add(it.cursor)
+	if it.match != "" {
+		args = args.Add("MATCH", it.match)
+	}
+	if it.count > 0 {
+		args = args.Add("COUNT", it.count)
+	}
+
+	var reply interface{}
+	var err error
+	if it.command == "SCAN" {
+		reply, err = it.scan(args)
+	} else {
+		reply, err = it.c.Do(it.ctx, it.command, args...)
+	}
+	values, err := redis.Values(reply, err)
+	if err != nil {
+		return err
+	}
+	if len(values) != 2 {
+		return redis.Error("redis: unexpected scan reply")
+	}
+	if it.cursor, err = redis.String(values[0], nil); err != nil {
+		return err
+	}
+	it.page, err = redis.Strings(values[1], nil)
+	return err
+}
+
+// scan sends SCAN to the current master in cluster mode, or to the current
+// shard otherwise, as keys are spread across all of them.
+func (it *ScanIterator) scan(args redis.Args) (interface{}, error) {
+	if err := it.ctx.Err(); err != nil {
+		return nil, err
+	}
+	var conn redis.Conn
+	if cl := it.c.p.cluster; cl != nil {
+		if len(it.nodes) == 0 {
+			return nil, ErrNoClusterNode
+		}
+		pc, err := cl.conn(it.ctx, it.nodes[it.node])
+		if err != nil {
+			return nil, err
+		}
+		conn = pc
+	} else {
+		raw, err := it.shards[it.node].Get(it.ctx)
+		if err != nil {
+			return nil, err
+		}
+		conn = borrowed(raw, it.dp, it.ctx)
+	}
+	defer conn.Close()
+	return conn.Do("SCAN", args...)
+}
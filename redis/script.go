@@ -0,0 +1,148 @@
+package redis
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Script is a Lua script run by EVALSHA, falling back to EVAL when the
+// server does not have it cached.
+type Script struct {
+	keyCount int
+	src      string
+	hash     string
+}
+
+// NewScript returns a script with keyCount keys, the first keyCount
+// arguments of Do are the keys.
+func NewScript(keyCount int, src string) *Script {
+	h := sha1.Sum([]byte(src))
+	return &Script{keyCount: keyCount, src: src, hash: hex.EncodeToString(h[:])}
+}
+
+// Hash returns the SHA1 hex digest of the script.
+func (s *Script) Hash() string {
+	return s.hash
+}
+
+func (s *Script) args(spec string, keysAndArgs []interface{}) []interface{} {
+	args := make([]interface{}, 2+len(keysAndArgs))
+	args[0] = spec
+	args[1] = s.keyCount
+	copy(args[2:], keysAndArgs)
+	return args
+}
+
+// Do runs the script by EVALSHA, and by EVAL if the server replies NOSCRIPT.
+func (s *Script) Do(c redis.Conn, keysAndArgs ...interface{}) (interface{}, error) {
+	reply, err := c.Do("EVALSHA", s.args(s.hash, keysAndArgs)...)
+	if e, ok := err.(redis.Error); ok && strings.HasPrefix(string(e), "NOSCRIPT ") {
+		reply, err = c.Do("EVAL", s.args(s.src, keysAndArgs)...)
+	}
+	return reply, err
+}
+
+// Load loads the script into the script cache of the server of c.
+func (s *Script) Load(c redis.Conn) error {
+	_, err := c.Do("SCRIPT", "LOAD", s.src)
+	return err
+}
+
+// Eval runs script on the shard of its first key, or any shard if it has no key.
+func (c *Cmd) Eval(ctx context.Context, script *Script, keysAndArgs ...interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var conn redis.Conn
+	if script.keyCount > 0 && len(keysAndArgs) > 0 {
+		conn = c.p.GetForKeyContext(ctx, keyString(keysAndArgs[0]))
+	} else {
+		conn = c.p.GetContext(ctx)
+	}
+	defer conn.Close()
+	return script.Do(conn, keysAndArgs...)
+}
+
+// scriptSet is the scripts registered on a RedisPool, they are loaded on
+// the server of every shard when the shard is created or available again.
+type scriptSet struct {
+	connFactory PooledConnFactory
+
+	mu      sync.Mutex
+	scripts []*Script
+}
+
+func newScriptSet(connFactory PooledConnFactory) *scriptSet {
+	return &scriptSet{connFactory: connFactory}
+}
+
+func (ss *scriptSet) add(scripts []*Script) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for _, s := range scripts {
+		ss.scripts = append(ss.scripts, s)
+	}
+}
+
+// load loads all scripts on server by a connection out of the pool.
+func (ss *scriptSet) load(server string) error {
+	ss.mu.Lock()
+	scripts := append([]*Script(nil), ss.scripts...)
+	ss.mu.Unlock()
+	if len(scripts) == 0 {
+		return nil
+	}
+
+	raw, err := ss.connFactory.Create(server)
+	if err != nil {
+		return err
+	}
+	defer ss.connFactory.Close(raw)
+	c, ok := raw.(redis.Conn)
+	if !ok {
+		return nil
+	}
+	for _, s := range scripts {
+		if err = s.Load(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hook returns poolConfig loading the scripts on available servers before
+// its own OnAvailable, errors are left to the EVAL fallback of Script.Do.
+func (ss *scriptSet) hook(poolConfig PoolConfig) PoolConfig {
+	next := poolConfig.OnAvailable
+	poolConfig.OnAvailable = func(server string) {
+		ss.load(server)
+		if next != nil {
+			next(server)
+		}
+	}
+	return poolConfig
+}
+
+// LoadScripts registers scripts and loads them on every shard, including
+// shards created later, e.g. on failover, or available again after being
+// marked down, so that EVALSHA rarely falls back to EVAL. It returns the
+// first error, the other shards are loaded anyway.
+func (p *RedisPool) LoadScripts(scripts ...*Script) (err error) {
+	p.scripts.add(scripts)
+	for _, dp := range p.pools() {
+		for _, shard := range dp.Shards() {
+			if !shard.Available() {
+				continue
+			}
+			if e := p.scripts.load(shard.Server()); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,60 @@
+package redis
+
+import (
+	"context"
+	"testing"
+
+	"github.com/feekk/zddgo/redis/redistest"
+)
+
+func TestScript(t *testing.T) {
+	cache := map[string]bool{}
+	var calls []string
+	s := redistest.NewServer()
+	s.Handle("SCRIPT", func(args []string) interface{} {
+		calls = append(calls, "SCRIPT")
+		cache[NewScript(0, args[1]).Hash()] = true
+		return NewScript(0, args[1]).Hash()
+	})
+	s.Handle("EVALSHA", func(args []string) interface{} {
+		calls = append(calls, "EVALSHA")
+		if !cache[args[0]] {
+			return redistest.Error("NOSCRIPT No matching script. Please use EVAL.")
+		}
+		return args[2]
+	})
+	s.Handle("EVAL", func(args []string) interface{} {
+		calls = append(calls, "EVAL")
+		cache[NewScript(0, args[0]).Hash()] = true
+		return args[2]
+	})
+	defer s.Close()
+	p := NewRedisPool([]string{s.Addr()}, DefaultRedisPooledConnFactory, DefaultPoolConfig)
+	defer p.Close()
+	ctx := context.Background()
+
+	script := NewScript(1, "return KEYS[1]")
+	if h := NewScript(0, "return 1").Hash(); h != "e0e1f9fabfc9d4800c877a703b823ac0578ff8db" {
+		t.Fatalf("got %s", h)
+	}
+	reply, err := p.Cmd().Eval(ctx, script, "k1")
+	if v, _ := reply.([]byte); err != nil || string(v) != "k1" {
+		t.Fatalf("got %v %v", reply, err)
+	}
+	if len(calls) != 2 || calls[0] != "EVALSHA" || calls[1] != "EVAL" {
+		t.Fatalf("got %v", calls)
+	}
+
+	// Loaded scripts are run by EVALSHA only
+	other := NewScript(1, "return ARGV[1]")
+	if err = p.LoadScripts(other); err != nil {
+		t.Fatal(err)
+	}
+	calls = nil
+	if _, err = p.Cmd().Eval(ctx, other, "k1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 1 || calls[0] != "EVALSHA" {
+		t.Fatalf("got %v", calls)
+	}
+}
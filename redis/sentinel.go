@@ -0,0 +1,347 @@
+package redis
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ErrNoMaster is returned when no sentinel knows the master.
+var ErrNoMaster error = errors.New("sentinel: no master found")
+
+type SentinelConfig struct {
+	// Name of the master monitored by sentinels
+	MasterName string
+	// Sentinel address list, e.t. []string{"127.0.0.1:26379", "127.0.0.1:26380"}
+	Addrs    []string
+	Password string
+	// Timeouts of the sentinel connections, the subscription waits two
+	// PingIntervals for a reply instead of ReadTimeout
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	// Interval of PING on the +switch-master subscription, which reconnects
+	// if nothing is received in two intervals. 30 seconds by default
+	PingInterval time.Duration
+	// Keep a pool of healthy replicas for RedisPool.GetReplica
+	ReadFromReplicas bool
+	// Wait between reconnects of the +switch-master subscription
+	RetryInterval time.Duration
+}
+
+// Sentinel discovers the master by sentinels, and rebuilds the pool on failover.
+type Sentinel struct {
+	conf        SentinelConfig
+	connFactory PooledConnFactory
+	poolConfig  PoolConfig
+
+	// Guards addrs, masterAddr, replicaAddrs and sub
+	mu           sync.Mutex
+	addrs        []string
+	masterAddr   string
+	replicaAddrs []string
+	sub          redis.Conn
+
+	// @atomic *Pool of the master and the replicas, the replicas one may be nil
+	master  atomic.Value
+	replica atomic.Value
+
+	stopper chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewSentinelPool creates a RedisPool on the master discovered by sentinels.
+// The pool follows +switch-master events, connections borrowed from the old
+// master are closed when returned.
+func NewSentinelPool(conf SentinelConfig, connFactory PooledConnFactory, poolConfig PoolConfig) (*RedisPool, error) {
+	if conf.MasterName == "" || len(conf.Addrs) == 0 || connFactory == nil {
+		panic("Illegal Arguments")
+	}
+	if conf.RetryInterval <= 0 {
+		conf.RetryInterval = time.Second
+	}
+	if conf.PingInterval <= 0 {
+		conf.PingInterval = 30 * time.Second
+	}
+	scripts := newScriptSet(connFactory)
+	poolConfig = scripts.hook(poolConfig)
+	s := &Sentinel{
+		conf:        conf,
+		connFactory: connFactory,
+		poolConfig:  poolConfig,
+		addrs:       append([]string(nil), conf.Addrs...),
+		stopper:     make(chan struct{}),
+	}
+	s.replica.Store((*Pool)(nil))
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+	s.wg.Add(1)
+	go s.goWatch()
+	return &RedisPool{sentinel: s, scripts: scripts}, nil
+}
+
+// MasterAddr returns the current master address.
+func (s *Sentinel) MasterAddr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.masterAddr
+}
+
+func (s *Sentinel) masterPool() *Pool {
+	return s.master.Load().(*Pool)
+}
+
+func (s *Sentinel) replicaPool() *Pool {
+	return s.replica.Load().(*Pool)
+}
+
+func (s *Sentinel) dial(addr string) (redis.Conn, error) {
+	return redis.Dial("tcp", addr,
+		redis.DialConnectTimeout(s.conf.ConnectTimeout),
+		redis.DialReadTimeout(s.conf.ReadTimeout),
+		redis.DialWriteTimeout(s.conf.ReadTimeout),
+		redis.DialPassword(s.conf.Password),
+	)
+}
+
+// query runs f on the first sentinel which answers, and moves it to the front.
+func (s *Sentinel) query(f func(c redis.Conn) error) (err error) {
+	s.mu.Lock()
+	addrs := append([]string(nil), s.addrs...)
+	s.mu.Unlock()
+
+	err = ErrNoMaster
+	for i, addr := range addrs {
+		var c redis.Conn
+		if c, err = s.dial(addr); err != nil {
+			continue
+		}
+		err = f(c)
+		c.Close()
+		if err != nil {
+			continue
+		}
+		if i > 0 {
+			s.mu.Lock()
+			s.addrs[0], s.addrs[i] = s.addrs[i], s.addrs[0]
+			s.mu.Unlock()
+		}
+		return nil
+	}
+	return err
+}
+
+// refresh asks sentinels for the master and replicas, and rebuilds the pools if changed.
+func (s *Sentinel) refresh() error {
+	var master string
+	var replicas []string
+	err := s.query(func(c redis.Conn) error {
+		addr, err := redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", s.conf.MasterName))
+		if err == redis.ErrNil || (err == nil && len(addr) != 2) {
+			return ErrNoMaster
+		}
+		if err != nil {
+			return err
+		}
+		master = addr[0] + ":" + addr[1]
+		if s.conf.ReadFromReplicas {
+			replicas, err = sentinelReplicas(c, s.conf.MasterName)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.switchMaster(master)
+	if s.conf.ReadFromReplicas {
+		s.switchReplicas(replicas)
+	}
+	return nil
+}
+
+// sentinelReplicas returns the healthy replicas of master.
+func sentinelReplicas(c redis.Conn, master string) (addrs []string, err error) {
+	values, err := redis.Values(c.Do("SENTINEL", "slaves", master))
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range values {
+		fields, err := redis.StringMap(v, nil)
+		if err != nil {
+			return nil, err
+		}
+		flags := fields["flags"]
+		if strings.Contains(flags, "s_down") || strings.Contains(flags, "o_down") || strings.Contains(flags, "disconnected") {
+			continue
+		}
+		if fields["master-link-status"] != "" && fields["master-link-status"] != "ok" {
+			continue
+		}
+		addrs = append(addrs, fields["ip"]+":"+fields["port"])
+	}
+	return addrs, nil
+}
+
+func (s *Sentinel) switchMaster(addr string) {
+	s.mu.Lock()
+	if addr == s.masterAddr {
+		s.mu.Unlock()
+		return
+	}
+	s.masterAddr = addr
+	s.mu.Unlock()
+
+	old, _ := s.master.Load().(*Pool)
+	s.master.Store(NewPool([]string{addr}, s.connFactory, s.poolConfig))
+	if old != nil {
+		old.Shutdown()
+	}
+}
+
+func (s *Sentinel) switchReplicas(addrs []string) {
+	s.mu.Lock()
+	if strings.Join(addrs, ";") == strings.Join(s.replicaAddrs, ";") {
+		s.mu.Unlock()
+		return
+	}
+	s.replicaAddrs = addrs
+	s.mu.Unlock()
+
+	var p *Pool
+	if len(addrs) > 0 {
+		p = NewPool(addrs, s.connFactory, s.poolConfig)
+	}
+	old := s.replicaPool()
+	s.replica.Store(p)
+	if old != nil {
+		old.Shutdown()
+	}
+}
+
+// goWatch subscribes +switch-master, reconnecting and refreshing after errors
+// since events may be missed meanwhile.
+func (s *Sentinel) goWatch() {
+	defer s.wg.Done()
+	for {
+		err := s.watch()
+		select {
+		case <-s.stopper:
+			return
+		case <-time.After(s.conf.RetryInterval):
+		}
+		if err != nil {
+			s.refresh()
+		}
+	}
+}
+
+func (s *Sentinel) watch() (err error) {
+	s.mu.Lock()
+	addrs := append([]string(nil), s.addrs...)
+	s.mu.Unlock()
+
+	// No read timeout, events may not come for a long time, see goPing
+	var c redis.Conn
+	for _, addr := range addrs {
+		c, err = redis.Dial("tcp", addr,
+			redis.DialConnectTimeout(s.conf.ConnectTimeout),
+			redis.DialPassword(s.conf.Password),
+		)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	select {
+	case <-s.stopper:
+		s.mu.Unlock()
+		c.Close()
+		return nil
+	default:
+	}
+	s.sub = c
+	s.mu.Unlock()
+
+	psc := redis.PubSubConn{Conn: c}
+	defer psc.Close()
+	if err = psc.Subscribe("+switch-master", "+slave", "+sdown", "-sdown"); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go s.goPing(c, done)
+	for {
+		switch v := psc.ReceiveWithTimeout(2 * s.conf.PingInterval).(type) {
+		case redis.Message:
+			s.handle(v.Channel, string(v.Data))
+		case redis.Subscription:
+			if v.Count == 4 {
+				// Subscribed, catch up with events missed before
+				s.refresh()
+			}
+		case error:
+			return v
+		}
+	}
+}
+
+// goPing pings the subscription c until done, so that watch times out on a
+// half-open connection. The PONG replies are dropped by watch.
+func (s *Sentinel) goPing(c redis.Conn, done chan struct{}) {
+	ticker := time.NewTicker(s.conf.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			c.Send("PING")
+			c.Flush()
+		}
+	}
+}
+
+// handle applies a sentinel event, +switch-master payload is
+// "<master name> <old ip> <old port> <new ip> <new port>".
+func (s *Sentinel) handle(channel, payload string) {
+	parts := strings.Fields(payload)
+	switch channel {
+	case "+switch-master":
+		if len(parts) != 5 || parts[0] != s.conf.MasterName {
+			return
+		}
+		s.switchMaster(parts[3] + ":" + parts[4])
+		if s.conf.ReadFromReplicas {
+			s.refresh()
+		}
+	default:
+		// Replica events, "<instance type> <name> <ip> <port> @ <master name> <master ip> <master port>"
+		if s.conf.ReadFromReplicas && len(parts) >= 6 && parts[5] == s.conf.MasterName {
+			s.refresh()
+		}
+	}
+}
+
+// Close stops watching and shuts down the pools.
+func (s *Sentinel) Close() {
+	s.mu.Lock()
+	close(s.stopper)
+	if s.sub != nil {
+		s.sub.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+
+	s.masterPool().Shutdown()
+	if p := s.replicaPool(); p != nil {
+		p.Shutdown()
+	}
+}
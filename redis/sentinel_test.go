@@ -0,0 +1,154 @@
+package redis
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/feekk/zddgo/redis/redistest"
+)
+
+// fakeSentinel answers the sentinel commands used by Sentinel.
+type fakeSentinel struct {
+	*redistest.Server
+
+	mu       sync.Mutex
+	master   []string
+	replicas [][]string
+	// Number of SENTINEL commands, sent again on every reconnect
+	queries int
+	// Ignore PING, as a half-open connection
+	mute bool
+}
+
+func newFakeSentinel() *fakeSentinel {
+	s := &fakeSentinel{Server: redistest.NewServer(), master: []string{"10.0.0.1", "6379"}}
+	s.Handle("SENTINEL", func(args []string) interface{} {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.queries++
+		if strings.ToLower(args[0]) == "get-master-addr-by-name" {
+			return s.master
+		}
+		reply := []interface{}{}
+		for _, r := range s.replicas {
+			reply = append(reply, r)
+		}
+		return reply
+	})
+	// Only sent on the subscription
+	s.Handle("PING", func(args []string) interface{} {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.mute {
+			return redistest.NoReply
+		}
+		return []string{"pong", ""}
+	})
+	return s
+}
+
+// waitSubscribed waits for the subscription of Sentinel, by events of
+// another master that it ignores.
+func (s *fakeSentinel) waitSubscribed(t *testing.T) {
+	for i := 0; s.Publish("+switch-master", "other 10.0.0.9 6379 10.0.0.8 6379") == 0; i++ {
+		if i > 100 {
+			t.Fatal("not subscribed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSentinelSwitchMaster(t *testing.T) {
+	fs := newFakeSentinel()
+	defer fs.Close()
+	fs.replicas = [][]string{
+		{"ip", "10.0.0.2", "port", "6379", "flags", "slave", "master-link-status", "ok"},
+		{"ip", "10.0.0.3", "port", "6379", "flags", "slave,s_down", "master-link-status", "err"},
+	}
+
+	p, err := NewSentinelPool(SentinelConfig{
+		MasterName:       "mymaster",
+		Addrs:            []string{"127.0.0.1:1", fs.Addr()},
+		ReadFromReplicas: true,
+		RetryInterval:    10 * time.Millisecond,
+	}, &testFactory{}, DefaultPoolConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	s := p.Sentinel()
+	if s.MasterAddr() != "10.0.0.1:6379" {
+		t.Fatalf("master %s", s.MasterAddr())
+	}
+	if replicas := s.replicaPool().Servers(); len(replicas) != 1 || replicas[0] != "10.0.0.2:6379" {
+		t.Fatalf("replicas %v", replicas)
+	}
+	old := p.pool()
+	c, err := old.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs.waitSubscribed(t)
+	fs.mu.Lock()
+	fs.master = []string{"10.0.0.2", "6379"}
+	fs.replicas = nil
+	fs.mu.Unlock()
+	fs.Publish("+switch-master", "mymaster 10.0.0.1 6379 10.0.0.2 6379")
+
+	for i := 0; s.MasterAddr() != "10.0.0.2:6379"; i++ {
+		if i > 100 {
+			t.Fatal("master not switched")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if p.pool() == old || p.pool().Servers()[0] != "10.0.0.2:6379" {
+		t.Error("pool not rebuilt")
+	}
+	// Connections of the old master are closed when returned
+	old.Put(c, false)
+	if stats := old.GetPoolStats(); stats[0].NumActive != 0 {
+		t.Errorf("old master connection kept %+v", stats[0])
+	}
+}
+
+func TestSentinelWatchPing(t *testing.T) {
+	fs := newFakeSentinel()
+	defer fs.Close()
+	p, err := NewSentinelPool(SentinelConfig{
+		MasterName:    "mymaster",
+		Addrs:         []string{fs.Addr()},
+		RetryInterval: 10 * time.Millisecond,
+		PingInterval:  20 * time.Millisecond,
+	}, &testFactory{}, DefaultPoolConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	queries := func() int {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		return fs.queries
+	}
+	fs.waitSubscribed(t)
+	// Answered pings keep the subscription, which queries again on reconnect
+	time.Sleep(50 * time.Millisecond)
+	n := queries()
+	time.Sleep(100 * time.Millisecond)
+	if queries() != n {
+		t.Fatal("subscription reconnected")
+	}
+	fs.mu.Lock()
+	fs.mute = true
+	fs.mu.Unlock()
+	for i := 0; queries() == n; i++ {
+		if i > 100 {
+			t.Fatal("half-open subscription not reconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,386 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// StreamMessage is an entry of a stream delivered to a StreamHandler.
+type StreamMessage struct {
+	Stream string
+	ID     string
+	Values map[string]string
+	// Times the entry has been delivered, including this one
+	Deliveries int64
+}
+
+// StreamHandler handles an entry, which is acknowledged if it returns nil.
+// Otherwise the entry stays pending and is claimed again after ClaimMinIdle.
+type StreamHandler func(ctx context.Context, msg *StreamMessage) error
+
+type StreamWorkerConfig struct {
+	Stream   string
+	Group    string
+	Consumer string
+	// ID the group starts from if created, "$" by default for new entries
+	// only, "0" for the whole stream
+	StartID string
+	// Handlers running at the same time, 10 by default
+	Concurrency int
+	// Maximum entries of one XREADGROUP or XAUTOCLAIM, Concurrency by default
+	BatchSize int
+	// BLOCK of XREADGROUP, 2 seconds by default. Stop waits for it at most
+	Block time.Duration
+	// Pending entries idle longer than this are claimed from any consumer,
+	// e.g. a crashed one, 1 minute by default
+	ClaimMinIdle time.Duration
+	// Interval of XAUTOCLAIM, ClaimMinIdle/2 by default
+	ClaimInterval time.Duration
+	// Entries claimed after MaxDeliveries deliveries are moved to
+	// DeadLetterStream and acknowledged, 5 by default
+	MaxDeliveries int64
+	// Stream + ":dead" by default. Dead letters keep the values, with the
+	// original ID in the "_id" field
+	DeadLetterStream string
+	// Optional, called with the errors of handlers, including panics, and of
+	// the commands of the worker. msg is nil for command errors
+	OnError func(msg *StreamMessage, err error)
+}
+
+// StreamWorker consumes a stream as a member of a consumer group.
+type StreamWorker struct {
+	conf    StreamWorkerConfig
+	cmd     *Cmd
+	handler StreamHandler
+
+	// Free handler slots
+	slots chan struct{}
+
+	stopper  chan struct{}
+	wg       sync.WaitGroup
+	handlers sync.WaitGroup
+}
+
+// NewStreamWorker creates a worker handling the entries of conf.Stream by h,
+// it is started by Start.
+func (p *RedisPool) NewStreamWorker(conf StreamWorkerConfig, h StreamHandler) *StreamWorker {
+	if conf.Stream == "" || conf.Group == "" || conf.Consumer == "" || h == nil {
+		panic("Illegal Arguments")
+	}
+	if conf.StartID == "" {
+		conf.StartID = "$"
+	}
+	if conf.Concurrency <= 0 {
+		conf.Concurrency = 10
+	}
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = conf.Concurrency
+	}
+	if conf.Block <= 0 {
+		conf.Block = 2 * time.Second
+	}
+	if conf.ClaimMinIdle <= 0 {
+		conf.ClaimMinIdle = time.Minute
+	}
+	if conf.ClaimInterval <= 0 {
+		conf.ClaimInterval = conf.ClaimMinIdle / 2
+	}
+	if conf.MaxDeliveries <= 0 {
+		conf.MaxDeliveries = 5
+	}
+	if conf.DeadLetterStream == "" {
+		conf.DeadLetterStream = conf.Stream + ":dead"
+	}
+	return &StreamWorker{
+		conf:    conf,
+		cmd:     p.Cmd(),
+		handler: h,
+		slots:   make(chan struct{}, conf.Concurrency),
+		stopper: make(chan struct{}),
+	}
+}
+
+// XAdd appends an entry to stream, and returns its ID.
+func (c *Cmd) XAdd(ctx context.Context, stream string, values map[string]interface{}) (string, error) {
+	args := []interface{}{stream, "*"}
+	for k, v := range values {
+		args = append(args, k, v)
+	}
+	return c.str(ctx, "XADD", args...)
+}
+
+// Start creates the group if not exists, and starts reading and claiming.
+// Handlers are called with ctx.
+func (w *StreamWorker) Start(ctx context.Context) error {
+	// Cmd.Do would pick the shard of "CREATE"
+	conn := w.cmd.p.GetForKeyContext(ctx, w.conf.Stream)
+	_, err := conn.Do("XGROUP", "CREATE", w.conf.Stream, w.conf.Group, w.conf.StartID, "MKSTREAM")
+	conn.Close()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	w.wg.Add(2)
+	go w.goRead(ctx)
+	go w.goClaim(ctx)
+	return nil
+}
+
+// Stop stops reading and claiming, and waits for running handlers.
+func (w *StreamWorker) Stop() {
+	close(w.stopper)
+	w.wg.Wait()
+	w.handlers.Wait()
+}
+
+func (w *StreamWorker) stopped() bool {
+	select {
+	case <-w.stopper:
+		return true
+	default:
+		return false
+	}
+}
+
+func (w *StreamWorker) onError(msg *StreamMessage, err error) {
+	if w.conf.OnError != nil {
+		w.conf.OnError(msg, err)
+	}
+}
+
+// goRead reads new entries by blocking XREADGROUP.
+func (w *StreamWorker) goRead(ctx context.Context) {
+	defer w.wg.Done()
+	for !w.stopped() {
+		msgs, err := w.read(ctx)
+		if err != nil {
+			w.onError(nil, err)
+			select {
+			case <-w.stopper:
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		for _, msg := range msgs {
+			msg.Deliveries = 1
+			w.dispatch(ctx, msg)
+		}
+	}
+}
+
+func (w *StreamWorker) read(ctx context.Context) ([]*StreamMessage, error) {
+	conn := w.cmd.p.GetForKeyContext(ctx, w.conf.Stream)
+	defer conn.Close()
+	// The read timeout of the connection is shorter than BLOCK
+	reply, err := redis.DoWithTimeout(conn, w.conf.Block+time.Second, "XREADGROUP",
+		"GROUP", w.conf.Group, w.conf.Consumer,
+		"COUNT", w.conf.BatchSize, "BLOCK", int64(w.conf.Block/time.Millisecond),
+		"STREAMS", w.conf.Stream, ">")
+	if err != nil || reply == nil {
+		// Nil reply if nothing came within BLOCK
+		return nil, err
+	}
+	streams, err := redis.Values(reply, nil)
+	if err != nil || len(streams) == 0 {
+		return nil, err
+	}
+	// Reply of one stream is [name, entries]
+	stream, err := redis.Values(streams[0], nil)
+	if err != nil || len(stream) != 2 {
+		return nil, err
+	}
+	msgs, _, err := w.parseEntries(stream[1])
+	return msgs, err
+}
+
+// parseEntries parses [[id, [field, value, ...]], ...], entries deleted
+// from the stream while pending have nil values and are returned in deleted.
+func (w *StreamWorker) parseEntries(reply interface{}) (msgs []*StreamMessage, deleted []string, err error) {
+	entries, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, e := range entries {
+		entry, err := redis.Values(e, nil)
+		if err != nil || len(entry) != 2 {
+			return nil, nil, fmt.Errorf("stream: unexpected entry %v", e)
+		}
+		id, _ := redis.String(entry[0], nil)
+		if entry[1] == nil {
+			deleted = append(deleted, id)
+			continue
+		}
+		values, err := redis.StringMap(entry[1], nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		msgs = append(msgs, &StreamMessage{Stream: w.conf.Stream, ID: id, Values: values})
+	}
+	return msgs, deleted, nil
+}
+
+// dispatch runs the handler on a free slot, waiting for one if all are busy.
+func (w *StreamWorker) dispatch(ctx context.Context, msg *StreamMessage) {
+	w.slots <- struct{}{}
+	w.handlers.Add(1)
+	go func() {
+		defer func() {
+			<-w.slots
+			w.handlers.Done()
+		}()
+		if err := w.handle(ctx, msg); err != nil {
+			w.onError(msg, err)
+			return
+		}
+		if err := w.ack(ctx, msg.ID); err != nil {
+			w.onError(msg, err)
+		}
+	}()
+}
+
+// handle calls the handler, a panic is recovered and returned as an error
+// with its stack, for OnError.
+func (w *StreamWorker) handle(ctx context.Context, msg *StreamMessage) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			var buf [1024]byte
+			n := runtime.Stack(buf[:], false)
+			err = fmt.Errorf("stream: handler panic: %v, stack: %s", r, buf[:n])
+		}
+	}()
+	return w.handler(ctx, msg)
+}
+
+func (w *StreamWorker) ack(ctx context.Context, ids ...string) error {
+	args := []interface{}{w.conf.Stream, w.conf.Group}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	_, err := w.cmd.Do(ctx, "XACK", args...)
+	return err
+}
+
+// goClaim claims stale pending entries periodically.
+func (w *StreamWorker) goClaim(ctx context.Context) {
+	defer w.wg.Done()
+	ticker := time.NewTicker(w.conf.ClaimInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stopper:
+			return
+		case <-ticker.C:
+		}
+		if err := w.claim(ctx); err != nil {
+			w.onError(nil, err)
+		}
+	}
+}
+
+// claim walks the pending entries by XAUTOCLAIM. Entries delivered too many
+// times go to the dead letter stream, the others to the handler.
+func (w *StreamWorker) claim(ctx context.Context) error {
+	start := "0-0"
+	for !w.stopped() {
+		reply, err := redis.Values(w.cmd.Do(ctx, "XAUTOCLAIM", w.conf.Stream, w.conf.Group, w.conf.Consumer,
+			int64(w.conf.ClaimMinIdle/time.Millisecond), start, "COUNT", w.conf.BatchSize))
+		if err != nil {
+			return err
+		}
+		// [next start, entries], and deleted IDs since Redis 7
+		if len(reply) < 2 {
+			return fmt.Errorf("stream: unexpected XAUTOCLAIM reply %v", reply)
+		}
+		if start, err = redis.String(reply[0], nil); err != nil {
+			return err
+		}
+		msgs, deleted, err := w.parseEntries(reply[1])
+		if err != nil {
+			return err
+		}
+		if len(deleted) > 0 {
+			w.ack(ctx, deleted...)
+		}
+		if err = w.deliveries(ctx, msgs); err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			if msg.Deliveries > w.conf.MaxDeliveries {
+				if err = w.deadLetter(ctx, msg); err != nil {
+					w.onError(msg, err)
+				}
+				continue
+			}
+			w.dispatch(ctx, msg)
+		}
+		if start == "0-0" {
+			return nil
+		}
+	}
+	return nil
+}
+
+// deliveries sets the delivery counts of claimed entries by XPENDING.
+func (w *StreamWorker) deliveries(ctx context.Context, msgs []*StreamMessage) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	byID := make(map[string]*StreamMessage, len(msgs))
+	ids := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		byID[msg.ID] = msg
+		ids = append(ids, msg.ID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return compareID(ids[i], ids[j]) < 0 })
+
+	reply, err := redis.Values(w.cmd.Do(ctx, "XPENDING", w.conf.Stream, w.conf.Group,
+		ids[0], ids[len(ids)-1], len(ids), w.conf.Consumer))
+	if err != nil {
+		return err
+	}
+	// Entries are [id, consumer, idle milliseconds, deliveries]
+	for _, e := range reply {
+		entry, err := redis.Values(e, nil)
+		if err != nil || len(entry) != 4 {
+			return fmt.Errorf("stream: unexpected XPENDING entry %v", e)
+		}
+		id, _ := redis.String(entry[0], nil)
+		if msg, ok := byID[id]; ok {
+			msg.Deliveries, _ = redis.Int64(entry[3], nil)
+		}
+	}
+	return nil
+}
+
+// compareID compares stream IDs "<milliseconds>-<sequence>".
+func compareID(a, b string) int {
+	var am, as, bm, bs uint64
+	fmt.Sscanf(a, "%d-%d", &am, &as)
+	fmt.Sscanf(b, "%d-%d", &bm, &bs)
+	switch {
+	case am < bm, am == bm && as < bs:
+		return -1
+	case am == bm && as == bs:
+		return 0
+	}
+	return 1
+}
+
+// deadLetter moves msg to the dead letter stream.
+func (w *StreamWorker) deadLetter(ctx context.Context, msg *StreamMessage) error {
+	values := make(map[string]interface{}, len(msg.Values)+1)
+	for k, v := range msg.Values {
+		values[k] = v
+	}
+	values["_id"] = msg.ID
+	if _, err := w.cmd.XAdd(ctx, w.conf.DeadLetterStream, values); err != nil {
+		return err
+	}
+	return w.ack(ctx, msg.ID)
+}
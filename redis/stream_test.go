@@ -0,0 +1,175 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/feekk/zddgo/redis/redistest"
+)
+
+func TestStreamWorker(t *testing.T) {
+	var (
+		// Guards the state of the server, read by the test at the end
+		smu     sync.Mutex
+		created bool
+		fresh   = [][]string{{"1-0", "job", "ok"}, {"2-0", "job", "panic"}}
+		claimed = [][]string{{"3-0", "job", "dead"}, {"4-0", "job", "retry"}}
+		acked   []string
+		dead    []string
+	)
+	entries := func(entries [][]string) []interface{} {
+		reply := []interface{}{}
+		for _, e := range entries {
+			reply = append(reply, []interface{}{e[0], e[1:]})
+		}
+		return reply
+	}
+	s := redistest.NewServer()
+	defer s.Close()
+	handle := func(name string, h redistest.Handler) {
+		s.Handle(name, func(args []string) interface{} {
+			smu.Lock()
+			defer smu.Unlock()
+			return h(args)
+		})
+	}
+	handle("XGROUP", func(args []string) interface{} {
+		if created {
+			return redistest.Error("BUSYGROUP Consumer Group name already exists")
+		}
+		created = true
+		return redistest.Status("OK")
+	})
+	handle("XREADGROUP", func(args []string) interface{} {
+		if len(fresh) == 0 {
+			time.Sleep(5 * time.Millisecond)
+			return redistest.NilArray
+		}
+		reply := []interface{}{[]interface{}{"jobs", entries(fresh)}}
+		fresh = nil
+		return reply
+	})
+	handle("XAUTOCLAIM", func(args []string) interface{} {
+		reply := []interface{}{"0-0", entries(claimed), []interface{}{}}
+		claimed = nil
+		return reply
+	})
+	handle("XPENDING", func(args []string) interface{} {
+		return []interface{}{
+			[]interface{}{"3-0", "w", 100, 6},
+			[]interface{}{"4-0", "w", 100, 2},
+		}
+	})
+	handle("XACK", func(args []string) interface{} {
+		acked = append(acked, args[2:]...)
+		return len(args) - 2
+	})
+	handle("XADD", func(args []string) interface{} {
+		dead = append(dead, args[0]+" "+strings.Join(args[2:], " "))
+		return "9-0"
+	})
+	p := NewRedisPool([]string{s.Addr()}, DefaultRedisPooledConnFactory, DefaultPoolConfig)
+	defer p.Close()
+
+	var mu sync.Mutex
+	var handled, failed []string
+	conf := StreamWorkerConfig{
+		Stream:        "jobs",
+		Group:         "g",
+		Consumer:      "w",
+		Block:         10 * time.Millisecond,
+		ClaimMinIdle:  time.Second,
+		ClaimInterval: 20 * time.Millisecond,
+		OnError: func(msg *StreamMessage, err error) {
+			if msg != nil {
+				mu.Lock()
+				failed = append(failed, msg.ID)
+				mu.Unlock()
+			}
+		},
+	}
+	w := p.NewStreamWorker(conf, func(ctx context.Context, msg *StreamMessage) error {
+		mu.Lock()
+		handled = append(handled, fmt.Sprintf("%s/%d", msg.ID, msg.Deliveries))
+		mu.Unlock()
+		switch msg.Values["job"] {
+		case "panic":
+			panic("boom")
+		case "retry":
+			return errors.New("retry later")
+		}
+		return nil
+	})
+	ctx := context.Background()
+	if err := w.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Group exists on restart
+	w2 := p.NewStreamWorker(conf, w.handler)
+	if err := w2.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	w.Stop()
+	w2.Stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	smu.Lock()
+	defer smu.Unlock()
+	if strings.Join(handled, ",") != "1-0/1,2-0/1,4-0/2" && strings.Join(handled, ",") != "2-0/1,1-0/1,4-0/2" {
+		t.Fatalf("handled %v", handled)
+	}
+	if len(failed) != 2 {
+		t.Fatalf("failed %v", failed)
+	}
+	if strings.Join(acked, ",") != "1-0,3-0" {
+		t.Fatalf("acked %v", acked)
+	}
+	if len(dead) != 1 || !strings.HasPrefix(dead[0], "jobs:dead ") || !strings.Contains(dead[0], "_id 3-0") {
+		t.Fatalf("dead %v", dead)
+	}
+}
+
+func TestStreamWorkerShards(t *testing.T) {
+	var servers []*redistest.Server
+	var mu sync.Mutex
+	groups := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		s := redistest.NewServer()
+		defer s.Close()
+		addr := s.Addr()
+		s.Handle("XGROUP", func(args []string) interface{} {
+			mu.Lock()
+			groups[addr+" "+args[1]] = true
+			mu.Unlock()
+			return redistest.Status("OK")
+		})
+		s.Handle("XREADGROUP", func(args []string) interface{} {
+			time.Sleep(5 * time.Millisecond)
+			return redistest.NilArray
+		})
+		servers = append(servers, s)
+	}
+	p := NewRedisPool([]string{servers[0].Addr(), servers[1].Addr()}, DefaultRedisPooledConnFactory, DefaultPoolConfig)
+	defer p.Close()
+
+	w := p.NewStreamWorker(StreamWorkerConfig{Stream: "jobs", Group: "g", Consumer: "w", Block: 10 * time.Millisecond},
+		func(ctx context.Context, msg *StreamMessage) error { return nil })
+	if err := w.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	w.Stop()
+
+	shard, _ := p.pool().ShardForKey("jobs")
+	mu.Lock()
+	defer mu.Unlock()
+	if len(groups) != 1 || !groups[shard.Server()+" jobs"] {
+		t.Errorf("group created on %v, stream on %s", groups, shard.Server())
+	}
+}
@@ -2,6 +2,7 @@ package utils
 
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"reflect"
@@ -15,21 +16,30 @@ func StdPrint(format string, values ...interface{}) {
 }
 
 func GoWithRecover(ctx *gin.Context, f reflect.Value, args ...interface{}){
-	defer func() {
-		if err := recover(); err != nil {
-			var buf [1024]byte
-			n := runtime.Stack(buf[:], false)
-			log.Error(ctx, log.TAG_Status_Internal_Server_Error, map[string]interface{}{
-				"err":   err,
-				"stack": string(buf[:n]),
-			})
-			
-		}
-	}()
+	defer Recover(ctx, nil)
 	n := len(args)
 	params := make([]reflect.Value, n)
 	for i:=0; i < n; i++ {
 		params[i] = reflect.ValueOf(args[i])
 	}
 	f.Call(params)
-}
\ No newline at end of file
+}
+//
+// Recover logs a panic of the calling goroutine, and sets it to *err if err is not nil.
+// It must be deferred, e.t. defer utils.Recover(ctx, &err)
+//
+func Recover(ctx context.Context, err *error){
+	r := recover()
+	if r == nil {
+		return
+	}
+	var buf [1024]byte
+	n := runtime.Stack(buf[:], false)
+	log.Error(ctx, log.TAG_Status_Internal_Server_Error, map[string]interface{}{
+		"err":   r,
+		"stack": string(buf[:n]),
+	})
+	if err != nil {
+		*err = fmt.Errorf("panic: %v", r)
+	}
+}
@@ -1,13 +1,19 @@
 package zddgo
 
 import(
+	"context"
 	"net/http"
+	"sync"
 )
 func New() (z *Zddgo){
 	z = &Zddgo{}
 	return
 }
-type Zddgo struct{}
+type Zddgo struct{
+	mu sync.Mutex
+	adminHandler http.Handler
+	servers []*http.Server
+}
 func(z *Zddgo) InitConfig() (err error) {
 	err = ConfigInit()
 	return
@@ -20,8 +26,61 @@ func(z *Zddgo) InitCache() (err error) {
 	err = RedisInit(&Conf.Redis)
 	return
 }
+//
+// HttpAdmin sets the handler served on Conf.Http.Admin, AdminHandler() by default.
+//
+func(z *Zddgo) HttpAdmin(handler http.Handler) {
+	z.adminHandler = handler
+}
+//
+// HttpStart serves handler and the admin listener if configured, it blocks until
+// any of them stops and then closes the others.
+//
 func(z *Zddgo) HttpStart(handler http.Handler) (err error) {
-	svr := NewHttpSvr(&Conf.Http, handler)
-	err = svr.ListenAndServe()
+	confs := []*HttpSvrConfig{&Conf.Http}
+	handlers := []http.Handler{handler}
+	if Conf.Http.Admin != nil {
+		admin := z.adminHandler
+		if admin == nil {
+			admin = AdminHandler()
+		}
+		confs = append(confs, Conf.Http.Admin)
+		handlers = append(handlers, admin)
+	}
+
+	z.mu.Lock()
+	z.servers = make([]*http.Server, len(confs))
+	for i, c := range confs {
+		z.servers[i] = NewHttpSvr(c, handlers[i])
+	}
+	servers := z.servers
+	z.mu.Unlock()
+
+	errs := make(chan error, len(servers))
+	for i, svr := range servers {
+		go func(c *HttpSvrConfig, svr *http.Server){
+			errs <- ServeHttpSvr(c, svr)
+		}(confs[i], svr)
+	}
+	// ErrServerClosed means HttpShutdown is draining the others
+	if err = <-errs; err != http.ErrServerClosed {
+		for _, svr := range servers {
+			svr.Close()
+		}
+	}
 	return
-}
\ No newline at end of file
+}
+//
+// HttpShutdown gracefully shuts down all listeners started by HttpStart.
+//
+func(z *Zddgo) HttpShutdown(ctx context.Context) (err error) {
+	z.mu.Lock()
+	servers := z.servers
+	z.mu.Unlock()
+	for _, svr := range servers {
+		if serr := svr.Shutdown(ctx); serr != nil && err == nil {
+			err = serr
+		}
+	}
+	return
+}